@@ -0,0 +1,467 @@
+package nomt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"os"
+	"sync"
+)
+
+// BucketPageStore is a PageStore that keeps pages in a fixed number of buckets
+// of a single file, as an open-addressing hash table. A page's bucket is found
+// by probing from the one given by the hash of its page ID, and each page
+// holds its ID in its last 64 bytes to tell it apart from the pages it collides with.
+//
+// The file starts with a header, followed by the meta region, a byte per
+// bucket telling whether it is empty, holds a page or held a deleted page,
+// and the buckets themselves. The meta region is kept in memory, so that
+// probing reads no more than the page looked for, save for rare collisions.
+//
+// Like DirPageStore, pages are loaded on demand and held in memory until the next Flush.
+// To keep probing short, no more than maxBucketLoadPercent of the buckets hold pages.
+type BucketPageStore struct {
+	mu         sync.Mutex // guards the maps, meta, counts and err
+	file       *os.File
+	path       string
+	numBuckets uint64
+	seed       uint64
+	meta       []byte
+	count      int
+	err        error // the first error reading a page, or ErrPageStoreFull
+
+	pages   map[pageID]*Page // loaded pages
+	dirty   map[pageID]struct{}
+	deleted map[pageID]struct{}
+	// buckets holds the buckets of the pages found on disk since the last Flush,
+	// so that Flush writes or deletes them without probing again.
+	buckets map[pageID]uint64
+	// numFreed is the number of deleted pages found on disk, which keep
+	// their buckets until the end of the next Flush.
+	numFreed int
+}
+
+const (
+	bucketPageStoreMagic = "nomtpage"
+	// The header takes up the space of one page at the start of the file.
+	bucketPageStoreHeaderSize = int64(PageSize)
+
+	// Meta bytes of buckets. Those holding a page have their top bit set,
+	// and 7 bits of the hash of its page ID below it.
+	metaEmpty   = 0x00
+	metaDeleted = 0x7f
+	metaFull    = 0x80
+
+	maxBucketLoadPercent = 90
+)
+
+// ErrPageStoreFull is the error of a BucketPageStore once a page is added
+// beyond its load limit. The page is kept in memory, but Flush returns
+// ErrPageStoreFull without writing anything, and so does Commit for a tree
+// stored in it, before the batch is logged.
+var ErrPageStoreFull = errors.New("nomt: page store full")
+
+// OpenBucketPageStore opens the page store at path, creating it with
+// numBuckets buckets if needed. The file of a new store is sparse,
+// so buckets only take up disk space once pages are written to them.
+func OpenBucketPageStore(path string, numBuckets int) (*BucketPageStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &BucketPageStore{
+		file:    f,
+		path:    path,
+		pages:   make(map[pageID]*Page),
+		dirty:   make(map[pageID]struct{}),
+		deleted: make(map[pageID]struct{}),
+		buckets: make(map[pageID]uint64),
+	}
+	if err := s.load(numBuckets); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *BucketPageStore) load(numBuckets int) error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if numBuckets <= 0 {
+			return fmt.Errorf("%s: invalid number of buckets: %d", s.path, numBuckets)
+		}
+		s.numBuckets = uint64(numBuckets)
+		s.seed = rand.Uint64()
+		s.meta = make([]byte, s.numBuckets)
+		var header [bucketPageStoreHeaderSize]byte
+		copy(header[:], bucketPageStoreMagic)
+		binary.BigEndian.PutUint64(header[len(bucketPageStoreMagic):], s.numBuckets)
+		binary.BigEndian.PutUint64(header[len(bucketPageStoreMagic)+8:], s.seed)
+		if _, err := s.file.WriteAt(header[:], 0); err != nil {
+			return err
+		}
+		if err := s.file.Truncate(s.bucketOffset(s.numBuckets)); err != nil {
+			return err
+		}
+		return s.file.Sync()
+	}
+
+	var header [bucketPageStoreHeaderSize]byte
+	if _, err := s.file.ReadAt(header[:], 0); err != nil {
+		return err
+	}
+	if string(header[:len(bucketPageStoreMagic)]) != bucketPageStoreMagic {
+		return fmt.Errorf("%s: not a page store", s.path)
+	}
+	s.numBuckets = binary.BigEndian.Uint64(header[len(bucketPageStoreMagic):])
+	s.seed = binary.BigEndian.Uint64(header[len(bucketPageStoreMagic)+8:])
+	if s.numBuckets == 0 || info.Size() != s.bucketOffset(s.numBuckets) {
+		return fmt.Errorf("%s: invalid size %d for %d buckets", s.path, info.Size(), s.numBuckets)
+	}
+	s.meta = make([]byte, s.numBuckets)
+	if _, err := s.file.ReadAt(s.meta, bucketPageStoreHeaderSize); err != nil {
+		return err
+	}
+	for _, m := range s.meta {
+		if m&metaFull != 0 {
+			s.count++
+		}
+	}
+	return nil
+}
+
+// bucketOffset returns the offset of bucket in the file.
+// The meta region is padded to a whole number of pages.
+func (s *BucketPageStore) bucketOffset(bucket uint64) int64 {
+	metaPages := (s.numBuckets + uint64(PageSize) - 1) / uint64(PageSize)
+	return bucketPageStoreHeaderSize + int64(metaPages+bucket)*int64(PageSize)
+}
+
+// hash returns the hash of id, which places it in the table.
+func (s *BucketPageStore) hash(id *pageID) uint64 {
+	h := s.seed
+	for i := 0; i < len(id); i += 8 {
+		h = mix64(h ^ binary.BigEndian.Uint64(id[i:]))
+	}
+	return h
+}
+
+// mix64 is the finalizer of SplitMix64.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// find returns the bucket holding the page with the given ID and the page,
+// or a nil page if there is none. It must be called with mu held.
+func (s *BucketPageStore) find(id *pageID) (uint64, *Page, error) {
+	hash := s.hash(id)
+	tag := metaFull | byte(hash>>57)
+	bucket := hash % s.numBuckets
+	for range s.numBuckets {
+		switch s.meta[bucket] {
+		case metaEmpty:
+			return 0, nil, nil
+		case tag:
+			page, err := s.read(bucket)
+			if err != nil {
+				return 0, nil, fmt.Errorf("reading page %x: %w", id.path(), err)
+			}
+			if page.id == *id {
+				return bucket, page, nil
+			}
+		}
+		bucket = (bucket + 1) % s.numBuckets
+	}
+	return 0, nil, nil
+}
+
+// loadPage returns the page with the given ID from disk, or nil if there is none,
+// remembering its bucket. It must be called with mu held.
+func (s *BucketPageStore) loadPage(id *pageID) (*Page, error) {
+	bucket, page, err := s.find(id)
+	if page != nil {
+		s.buckets[*id] = bucket
+	}
+	return page, err
+}
+
+// fail records err as the store's error, unless it already has one.
+func (s *BucketPageStore) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Err returns the first error reading a page, or ErrPageStoreFull once a page
+// was added beyond the load limit. Once there is one, pages read since may be
+// wrong, and Flush returns it without writing anything.
+func (s *BucketPageStore) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// full reports whether the pages exceed the load limit, or would not all get a
+// bucket in the next Flush, as deleted pages keep theirs until it ends.
+// It must be called with mu held.
+func (s *BucketPageStore) full() bool {
+	return uint64(100*s.count) > maxBucketLoadPercent*s.numBuckets ||
+		uint64(s.count+s.numFreed) > s.numBuckets
+}
+
+// freeBucket returns a bucket for a new page with the given ID,
+// which must not be in the store. It must be called with mu held.
+func (s *BucketPageStore) freeBucket(id *pageID) (uint64, byte, error) {
+	hash := s.hash(id)
+	bucket := hash % s.numBuckets
+	for range s.numBuckets {
+		if s.meta[bucket]&metaFull == 0 {
+			return bucket, metaFull | byte(hash>>57), nil
+		}
+		bucket = (bucket + 1) % s.numBuckets
+	}
+	return 0, 0, ErrPageStoreFull
+}
+
+// release marks bucket as no longer holding a page, adding the pages of the
+// meta region it changes to changed. Probing goes past deleted pages' buckets,
+// so bucket is left marked deleted, unless the one after it is empty: then no
+// probe goes past it, and it is emptied along with the deleted ones before it.
+// It must be called with mu held.
+func (s *BucketPageStore) release(bucket uint64, changed map[uint64]struct{}) {
+	s.meta[bucket] = metaDeleted
+	changed[bucket/uint64(PageSize)] = struct{}{}
+	if s.meta[(bucket+1)%s.numBuckets] != metaEmpty {
+		return
+	}
+	for s.meta[bucket] == metaDeleted {
+		s.meta[bucket] = metaEmpty
+		changed[bucket/uint64(PageSize)] = struct{}{}
+		bucket = (bucket + s.numBuckets - 1) % s.numBuckets
+	}
+}
+
+func (s *BucketPageStore) read(bucket uint64) (*Page, error) {
+	page := &Page{}
+	if _, err := s.file.ReadAt(page.bytes(), s.bucketOffset(bucket)); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func (s *BucketPageStore) Page(path []byte) *Page {
+	return s.pageByID(newPageID(path))
+}
+
+func (s *BucketPageStore) pageByID(id pageID) *Page {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if page, ok := s.pages[id]; ok {
+		return page
+	}
+	if _, ok := s.deleted[id]; ok {
+		return nil
+	}
+	page, err := s.loadPage(&id)
+	if err != nil {
+		// An unreadable page is replaced by an empty one, so that the tree
+		// can be read on, and the store is failed.
+		s.fail(err)
+		page = &Page{}
+	}
+	if page != nil {
+		s.pages[id] = page
+	}
+	return page
+}
+
+// exists reports whether there is a page with the given ID, without keeping it in memory.
+func (s *BucketPageStore) exists(id *pageID) bool {
+	if _, ok := s.pages[*id]; ok {
+		return true
+	}
+	if _, ok := s.deleted[*id]; ok {
+		return false
+	}
+	page, err := s.loadPage(id)
+	if err != nil {
+		s.fail(err)
+	}
+	return page != nil
+}
+
+func (s *BucketPageStore) Put(path []byte, page *Page) {
+	s.putByID(newPageID(path), page)
+}
+
+func (s *BucketPageStore) putByID(id pageID, page *Page) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.exists(&id) {
+		s.count++
+		if _, ok := s.deleted[id]; ok {
+			delete(s.deleted, id)
+			if _, ok := s.buckets[id]; ok {
+				// The page is written back to the bucket it was deleted from.
+				s.numFreed--
+			}
+		}
+		if s.full() {
+			// The page is kept, so that the tree can be read on,
+			// but the store is failed before anything is logged or written.
+			s.fail(ErrPageStoreFull)
+		}
+	}
+	page.id = id
+	s.pages[id] = page
+	s.dirty[id] = struct{}{}
+}
+
+func (s *BucketPageStore) Delete(path []byte) {
+	s.deleteByID(newPageID(path))
+}
+
+func (s *BucketPageStore) deleteByID(id pageID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exists(&id) {
+		s.count--
+		if _, ok := s.buckets[id]; ok {
+			s.numFreed++
+		}
+	}
+	delete(s.pages, id)
+	delete(s.dirty, id)
+	s.deleted[id] = struct{}{}
+}
+
+// Changes calls fn for each page modified since the last Flush,
+// passing a nil page for deleted pages.
+func (s *BucketPageStore) Changes(fn func(path []byte, page *Page)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range s.dirty {
+		fn(id.path(), s.pages[id])
+	}
+	for id := range s.deleted {
+		fn(id.path(), nil)
+	}
+}
+
+func (s *BucketPageStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Range calls fn for each page. Pages not already in memory are read
+// from disk without being retained. fn is called without the store locked.
+func (s *BucketPageStore) Range(fn func(path []byte, page *Page) bool) error {
+	s.mu.Lock()
+	loaded := maps.Clone(s.pages)
+	deleted := maps.Clone(s.deleted)
+	meta := bytes.Clone(s.meta)
+	s.mu.Unlock()
+	for id, page := range loaded {
+		if !fn(id.path(), page) {
+			return nil
+		}
+	}
+	for bucket, m := range meta {
+		if m&metaFull == 0 {
+			continue
+		}
+		page, err := s.read(uint64(bucket))
+		if err != nil {
+			return err
+		}
+		if _, ok := loaded[page.id]; ok {
+			continue
+		}
+		if _, ok := deleted[page.id]; ok {
+			continue
+		}
+		if !fn(page.id.path(), page) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Flush writes modified pages to disk, then the meta bytes of the buckets
+// they were written to or deleted from, and drops all pages from memory.
+//
+// New pages are only written to buckets that were free before the Flush,
+// so that a crash part way through never overwrites a page still in the
+// meta region on disk. The write-ahead log of a Tree then replays the rest.
+func (s *BucketPageStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	changed := make(map[uint64]struct{}) // pages of the meta region to write
+	for id := range s.dirty {
+		// Pages on disk were found when they were loaded or put.
+		bucket, ok := s.buckets[id]
+		if !ok {
+			var tag byte
+			var err error
+			bucket, tag, err = s.freeBucket(&id)
+			if err != nil {
+				return err
+			}
+			s.meta[bucket] = tag
+			changed[bucket/uint64(PageSize)] = struct{}{}
+		}
+		if _, err := s.file.WriteAt(s.pages[id].bytes(), s.bucketOffset(bucket)); err != nil {
+			return err
+		}
+	}
+	// Deleted pages keep their buckets until the new pages are written.
+	for id := range s.deleted {
+		if bucket, ok := s.buckets[id]; ok {
+			s.release(bucket, changed)
+		}
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	for metaPage := range changed {
+		start := metaPage * uint64(PageSize)
+		end := min(start+uint64(PageSize), s.numBuckets)
+		if _, err := s.file.WriteAt(s.meta[start:end], bucketPageStoreHeaderSize+int64(start)); err != nil {
+			return err
+		}
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	clear(s.pages)
+	clear(s.dirty)
+	clear(s.deleted)
+	clear(s.buckets)
+	s.numFreed = 0
+	return nil
+}
+
+// Close closes the file of the page store, without flushing it.
+// The store must not be used afterwards.
+func (s *BucketPageStore) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,184 @@
+package nomt
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketPageStore(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	path := filepath.Join(t.TempDir(), "pages.ht")
+	s, err := OpenBucketPageStore(path, 1_000)
+	require.NoError(t, err)
+
+	expected := make(map[string]Page)
+	requirePages := func() {
+		require.Equal(t, len(expected), s.Len())
+		for path, page := range expected {
+			require.Equal(t, page.Nodes, s.Page([]byte(path)).Nodes)
+		}
+		numPages := 0
+		require.NoError(t, s.Range(func(path []byte, page *Page) bool {
+			require.Equal(t, expected[string(path)].Nodes, page.Nodes)
+			numPages++
+			return true
+		}))
+		require.Equal(t, len(expected), numPages)
+	}
+
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 100; i++ {
+			path := make([]byte, r.Intn(MaxKeyLenPadded))
+			for j := range path {
+				path[j] = byte(r.Intn(1 << fullBits))
+			}
+			if r.Intn(3) == 0 {
+				// Delete short paths, which are likely to have been put.
+				path = path[:min(len(path), 1)]
+				s.Delete(path)
+				delete(expected, string(path))
+				continue
+			}
+			page := &Page{}
+			page.Nodes[0][0] = byte(round)
+			page.Nodes[1][0] = byte(i)
+			s.Put(path, page)
+			expected[string(path)] = *page
+		}
+		requirePages()
+		require.NoError(t, s.Flush())
+		requirePages()
+		if round%3 == 0 {
+			require.NoError(t, s.Close())
+			s, err = OpenBucketPageStore(path, 0)
+			require.NoError(t, err)
+			requirePages()
+		}
+	}
+	require.NoError(t, s.Close())
+}
+
+func TestBucketPageStoreChurn(t *testing.T) {
+	r := rand.New(rand.NewSource(8))
+	path := filepath.Join(t.TempDir(), "pages.ht")
+	s, err := OpenBucketPageStore(path, 400)
+	require.NoError(t, err)
+	live := make(map[byte]bool)
+	for round := 0; round < 3_000; round++ {
+		for i := 0; i < 5; i++ {
+			child := byte(r.Intn(1 << fullBits))
+			if live[child] {
+				s.Delete([]byte{child, 0})
+			} else {
+				s.Put([]byte{child, 0}, &Page{})
+			}
+			live[child] = !live[child]
+		}
+		require.NoError(t, s.Flush())
+	}
+	for child, ok := range live {
+		require.Equal(t, ok, s.Page([]byte{child, 0}) != nil)
+	}
+
+	// Deleting every page leaves every bucket empty, rather than marked deleted.
+	for child, ok := range live {
+		if ok {
+			s.Delete([]byte{child, 0})
+		}
+	}
+	require.NoError(t, s.Flush())
+	require.Zero(t, s.Len())
+	require.Equal(t, make([]byte, 400), s.meta)
+	require.NoError(t, s.Close())
+	s, err = OpenBucketPageStore(path, 0)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, 400), s.meta)
+	require.NoError(t, s.Close())
+}
+
+func TestBucketPageStoreFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pages.ht")
+	s, err := OpenBucketPageStore(path, 10)
+	require.NoError(t, err)
+	for i := 0; i < 9; i++ {
+		s.Put([]byte{byte(i)}, &Page{})
+	}
+	require.NoError(t, s.Flush())
+
+	// requireFull checks that the store failed and reopens it as last flushed.
+	requireFull := func() {
+		require.ErrorIs(t, s.Err(), ErrPageStoreFull)
+		require.ErrorIs(t, s.Flush(), ErrPageStoreFull)
+		require.NoError(t, s.Close())
+		s, err = OpenBucketPageStore(path, 0)
+		require.NoError(t, err)
+		require.Equal(t, 9, s.Len())
+		for i := 0; i < 9; i++ {
+			require.NotNil(t, s.Page([]byte{byte(i)}))
+		}
+		require.Nil(t, s.Page([]byte{10}))
+	}
+
+	// Only 90% of the buckets can hold pages.
+	s.Put([]byte{10}, &Page{})
+	require.NotNil(t, s.Page([]byte{10}))
+	requireFull()
+
+	// Deleted pages keep their buckets until the end of the Flush.
+	for i := 0; i < 5; i++ {
+		s.Delete([]byte{byte(i)})
+	}
+	s.Put([]byte{0}, &Page{})
+	s.Put([]byte{10}, &Page{})
+	require.NoError(t, s.Err())
+	s.Put([]byte{11}, &Page{})
+	requireFull()
+
+	// Once flushed, they make room for new pages.
+	s.Delete([]byte{0})
+	require.NoError(t, s.Flush())
+	s.Put([]byte{10}, &Page{})
+	require.NoError(t, s.Flush())
+	require.Equal(t, 9, s.Len())
+	require.NoError(t, s.Close())
+}
+
+func TestBucketPageStoreFullCommit(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := OpenTree(dir, WithPageBuckets(64))
+	require.NoError(t, err)
+	root := tr.Root()
+	for i := 0; ; i++ {
+		batch := testBatch(i*100, (i+1)*100)
+		newRoot, err := tr.Commit(batch)
+		if err != nil {
+			require.ErrorIs(t, err, ErrPageStoreFull)
+			break
+		}
+		root = newRoot
+	}
+	crash(t, tr)
+
+	// The failed batch was not logged, so the tree opens as last committed.
+	tr, err = OpenTree(dir)
+	require.NoError(t, err)
+	require.Equal(t, root, tr.Root())
+	require.NoError(t, tr.Close())
+}
+
+func TestBucketPageStoreReadError(t *testing.T) {
+	s, err := OpenBucketPageStore(filepath.Join(t.TempDir(), "pages.ht"), 64)
+	require.NoError(t, err)
+	s.Put([]byte{1}, &Page{})
+	require.NoError(t, s.Flush())
+
+	// Reads fail once the file is closed.
+	require.NoError(t, s.file.Close())
+	require.NotNil(t, s.Page([]byte{1}))
+	require.Error(t, s.Err())
+	s.Put([]byte{2}, &Page{})
+	require.ErrorIs(t, s.Flush(), s.Err())
+}
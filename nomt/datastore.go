@@ -1,30 +1,359 @@
 package nomt
 
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"unsafe"
+)
+
 const (
-	MaxChunks = 1 << 28
-	ChunkSize = 64
+	MaxChunks     = 1 << 28
+	ChunkSize     = 64
+	SegmentChunks = 1 << 15 // 2 MiB per segment
 )
 
+// Segment is a contiguous block of chunks in a Datastore.
+type Segment [SegmentChunks][ChunkSize]byte
+
+// Datastore holds the chunks storing leaf keys and values.
+// Chunks are handed out from segments allocated as they are needed,
+// so a chunk's index and address never change once allocated.
 type Datastore struct {
-	Data        [MaxChunks][ChunkSize]byte
-	FreeList    [MaxChunks]uint32
-	FreeListIdx int
+	Segments  [MaxChunks / SegmentChunks]*Segment
+	NumChunks uint32 // chunks at or above this index have never been allocated
+	FreeList  []uint32
+
+	// refs counts the references to chunks held by snapshots, on top of the
+	// tree's own. Chunks with references are not freed or written to.
+	refs map[uint32]uint32
+	// Chunks below readOnly belong to the datastore this one shadows,
+	// and are never freed or written to.
+	readOnly uint32
+
+	// Set for datastores opened with OpenDatastore.
+	file         *os.File
+	path         string
+	dirty        map[uint32]struct{} // blocks modified since the last Flush
+	needsRebuild bool
 }
 
 func New() *Datastore {
-	datastore := &Datastore{}
-	for i := uint32(0); i < MaxChunks; i++ {
-		datastore.Free(i)
-	}
-	return datastore
+	return &Datastore{}
 }
 
+// Chunk returns the chunk at idx, which must have been allocated.
+func (d *Datastore) Chunk(idx uint32) *[ChunkSize]byte {
+	return &d.Segments[idx/SegmentChunks][idx%SegmentChunks]
+}
+
+// Free drops a reference to the chunk at idx, returning it to the free list
+// once nothing references it.
 func (d *Datastore) Free(idx uint32) {
-	d.FreeList[d.FreeListIdx] = idx
-	d.FreeListIdx++
+	if idx < d.readOnly {
+		return
+	}
+	switch n := d.refs[idx]; n {
+	case 0:
+		d.FreeList = append(d.FreeList, idx)
+	case 1:
+		delete(d.refs, idx)
+	default:
+		d.refs[idx] = n - 1
+	}
+}
+
+// shared reports whether the chunk at idx is referenced by more than its leaf.
+func (d *Datastore) shared(idx uint32) bool {
+	return idx < d.readOnly || d.refs[idx] > 0
+}
+
+// shadow returns a datastore that reads d's chunks but never frees or writes
+// to them, allocating new chunks in segments of its own.
+func (d *Datastore) shadow() *Datastore {
+	return &Datastore{
+		Segments:  d.Segments,
+		NumChunks: (d.NumChunks + SegmentChunks - 1) / SegmentChunks * SegmentChunks,
+		readOnly:  d.NumChunks,
+	}
+}
+
+// ref adds a reference to the chunk at idx, to be dropped by Free.
+func (d *Datastore) ref(idx uint32) {
+	if d.refs == nil {
+		d.refs = make(map[uint32]uint32)
+	}
+	d.refs[idx]++
+}
+
+// ErrOutOfChunks is returned when all MaxChunks chunks of a Datastore are in use.
+var ErrOutOfChunks = errors.New("nomt: out of chunks")
+
+// Alloc returns the index of a chunk that is not in use,
+// or ErrOutOfChunks if there is none.
+func (d *Datastore) Alloc() (uint32, error) {
+	if d.Available() == 0 {
+		return 0, ErrOutOfChunks
+	}
+	return d.alloc(), nil
+}
+
+// alloc is Alloc, for callers that checked that enough chunks are available.
+func (d *Datastore) alloc() uint32 {
+	if n := len(d.FreeList); n > 0 {
+		idx := d.FreeList[n-1]
+		d.FreeList = d.FreeList[:n-1]
+		return idx
+	}
+	idx := d.NumChunks
+	d.grow(idx + 1)
+	return idx
+}
+
+// Available returns the number of chunks that can be allocated.
+func (d *Datastore) Available() int {
+	return MaxChunks - int(d.NumChunks) + len(d.FreeList)
+}
+
+// grow makes numChunks chunks available, without adding any to the free list.
+func (d *Datastore) grow(numChunks uint32) {
+	for i := d.NumChunks / SegmentChunks; i < (numChunks+SegmentChunks-1)/SegmentChunks; i++ {
+		if d.Segments[i] == nil {
+			d.Segments[i] = &Segment{}
+		}
+	}
+	d.NumChunks = max(d.NumChunks, numChunks)
+}
+
+// InUse returns the number of allocated chunks that have not been freed.
+func (d *Datastore) InUse() int {
+	return int(d.NumChunks) - len(d.FreeList)
 }
 
-func (d *Datastore) Alloc() uint32 {
-	d.FreeListIdx--
-	return d.FreeList[d.FreeListIdx]
+const (
+	datastoreMagic = "nomtdata"
+	// The header takes up the space of one chunk at the start of the file.
+	datastoreHeaderSize = ChunkSize
+	// Chunks are written back in blocks of this many chunks.
+	blockChunks = uint32(PageSize / ChunkSize)
+)
+
+// OpenDatastore opens the datastore persisted at path, creating it if needed.
+// Chunks are read into memory and written back by Flush.
+//
+// The free list is saved by Close. If the datastore was not closed cleanly,
+// NeedsRebuild reports true and chunks are not reused until RebuildFreeList is called.
+func OpenDatastore(path string) (*Datastore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	d := &Datastore{
+		file:  f,
+		path:  path,
+		dirty: make(map[uint32]struct{}),
+	}
+	if err := d.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Datastore) load() error {
+	info, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		// New datastore, with an empty free list.
+		return d.writeHeader(false)
+	}
+
+	var header [datastoreHeaderSize]byte
+	if _, err := d.file.ReadAt(header[:], 0); err != nil {
+		return err
+	}
+	if string(header[:len(datastoreMagic)]) != datastoreMagic {
+		return fmt.Errorf("%s: not a datastore", d.path)
+	}
+	clean := header[len(datastoreMagic)] == 1
+
+	// Chunks written past the end of the file were never allocated, or
+	// were lost in a crash along with any page referencing them.
+	numChunks := (info.Size() - datastoreHeaderSize) / ChunkSize
+	if numChunks > MaxChunks {
+		return fmt.Errorf("%s: too many chunks: %d", d.path, numChunks)
+	}
+	d.grow(uint32(numChunks))
+	for i := range d.Segments[:(d.NumChunks+SegmentChunks-1)/SegmentChunks] {
+		_, err := d.file.ReadAt(d.Segments[i].bytes(), datastoreHeaderSize+int64(i)*SegmentChunks*ChunkSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+
+	d.needsRebuild = !clean || d.readFreeList() != nil
+	// Until Close, the free list on disk may not match the chunks.
+	return d.writeHeader(false)
+}
+
+func (s *Segment) bytes() []byte {
+	return (*[SegmentChunks * ChunkSize]byte)(unsafe.Pointer(s))[:]
+}
+
+func (d *Datastore) writeHeader(clean bool) error {
+	var header [datastoreHeaderSize]byte
+	copy(header[:], datastoreMagic)
+	if clean {
+		header[len(datastoreMagic)] = 1
+	}
+	if _, err := d.file.WriteAt(header[:], 0); err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
+
+func (d *Datastore) freeListPath() string {
+	return d.path + ".free"
+}
+
+// readFreeList reads the free list saved by Close.
+// The file holds NumChunks, the free chunk indices and a CRC-32 checksum, all big-endian.
+func (d *Datastore) readFreeList() error {
+	data, err := os.ReadFile(d.freeListPath())
+	if err != nil {
+		return err
+	}
+	if len(data) < 8 || len(data)%4 != 0 {
+		return fmt.Errorf("%s: invalid size %d", d.freeListPath(), len(data))
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("%s: checksum mismatch", d.freeListPath())
+	}
+	if binary.BigEndian.Uint32(body) != d.NumChunks {
+		return fmt.Errorf("%s: saved for %d chunks, have %d", d.freeListPath(), binary.BigEndian.Uint32(body), d.NumChunks)
+	}
+	freeList := make([]uint32, 0, len(body)/4-1)
+	for pos := 4; pos < len(body); pos += 4 {
+		idx := binary.BigEndian.Uint32(body[pos:])
+		if idx >= d.NumChunks {
+			return fmt.Errorf("%s: invalid chunk %d", d.freeListPath(), idx)
+		}
+		freeList = append(freeList, idx)
+	}
+	d.FreeList = freeList
+	return nil
+}
+
+func (d *Datastore) writeFreeList() error {
+	data := make([]byte, 0, 4*(len(d.FreeList)+2))
+	data = binary.BigEndian.AppendUint32(data, d.NumChunks)
+	for _, idx := range d.FreeList {
+		data = binary.BigEndian.AppendUint32(data, idx)
+	}
+	data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+	// The directory is synced too, so that the header is never marked clean
+	// while a free list saved earlier could still be found after a crash.
+	return replaceFile(d.freeListPath(), data)
+}
+
+// NeedsRebuild reports whether the free list could not be recovered
+// and must be rebuilt with RebuildFreeList.
+func (d *Datastore) NeedsRebuild() bool {
+	return d.needsRebuild
+}
+
+// RebuildFreeList replaces the free list with every chunk not marked as in use.
+// walk must call mark for each chunk still referenced.
+func (d *Datastore) RebuildFreeList(walk func(mark func(idx uint32)) error) error {
+	used := make([]uint64, (d.NumChunks+63)/64)
+	err := walk(func(idx uint32) {
+		used[idx/64] |= 1 << (idx % 64)
+	})
+	if err != nil {
+		return err
+	}
+	d.FreeList = d.FreeList[:0]
+	// Free chunks in descending order so the lowest are reused first.
+	for idx := d.NumChunks; idx > 0; idx-- {
+		if used[(idx-1)/64]&(1<<((idx-1)%64)) == 0 {
+			d.FreeList = append(d.FreeList, idx-1)
+		}
+	}
+	d.needsRebuild = false
+	return nil
+}
+
+// chunkForWrite returns the chunk at idx, to be modified by the caller.
+func (d *Datastore) chunkForWrite(idx uint32) *[ChunkSize]byte {
+	if d.file != nil {
+		d.dirty[idx/blockChunks] = struct{}{}
+	}
+	return d.Chunk(idx)
+}
+
+// changes calls fn for each block of chunks modified since the last Flush.
+func (d *Datastore) changes(fn func(idx uint32, data []byte)) {
+	for block := range d.dirty {
+		idx := block * blockChunks
+		n := min(blockChunks, d.NumChunks-idx) // the file only covers allocated chunks
+		segment := d.Segments[idx/SegmentChunks].bytes()
+		start := int(idx%SegmentChunks) * ChunkSize
+		fn(idx, segment[start:start+int(n)*ChunkSize])
+	}
+}
+
+// restore overwrites the chunks starting at idx with data,
+// growing the datastore if needed.
+func (d *Datastore) restore(idx uint32, data []byte) {
+	n := uint32(len(data) / ChunkSize)
+	d.grow(idx + n)
+	for i := uint32(0); i < n; i++ {
+		copy(d.chunkForWrite(idx + i)[:], data[i*ChunkSize:])
+	}
+}
+
+// Flush writes the chunks modified since the last call to Flush.
+// It has no effect on datastores created by New.
+func (d *Datastore) Flush() error {
+	if d.file == nil {
+		return nil
+	}
+	var err error
+	d.changes(func(idx uint32, data []byte) {
+		if err == nil {
+			_, err = d.file.WriteAt(data, datastoreHeaderSize+int64(idx)*ChunkSize)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	clear(d.dirty)
+	return d.file.Sync()
+}
+
+// Close flushes the datastore, saves its free list and marks it as cleanly closed.
+func (d *Datastore) Close() error {
+	if d.file == nil {
+		return nil
+	}
+	if err := d.Flush(); err != nil {
+		return err
+	}
+	if !d.needsRebuild {
+		if err := d.writeFreeList(); err != nil {
+			return err
+		}
+		if err := d.writeHeader(true); err != nil {
+			return err
+		}
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
 }
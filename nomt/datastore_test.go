@@ -1 +1,101 @@
 package nomt
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustAlloc(t *testing.T, d *Datastore) uint32 {
+	idx, err := d.Alloc()
+	require.NoError(t, err)
+	return idx
+}
+
+func TestDatastoreGrow(t *testing.T) {
+	d := New()
+	require.Zero(t, d.InUse())
+	require.Nil(t, d.Segments[0])
+
+	// Allocating past the first segment allocates the next one.
+	for i := 0; i < SegmentChunks+1; i++ {
+		require.Equal(t, uint32(i), mustAlloc(t, d))
+	}
+	require.NotNil(t, d.Segments[1])
+	require.Nil(t, d.Segments[2])
+	require.Equal(t, SegmentChunks+1, d.InUse())
+
+	// Chunks keep their address as the datastore grows.
+	chunk := d.Chunk(1)
+	chunk[0] = 1
+	for i := 0; i < SegmentChunks; i++ {
+		mustAlloc(t, d)
+	}
+	require.Same(t, chunk, d.Chunk(1))
+	require.Equal(t, byte(1), d.Chunk(1)[0])
+
+	// Freed chunks are reused before growing.
+	numChunks := d.NumChunks
+	d.Free(1)
+	require.Equal(t, uint32(1), mustAlloc(t, d))
+	require.Equal(t, numChunks, d.NumChunks)
+}
+
+func TestOpenDatastore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chunks")
+	d, err := OpenDatastore(path)
+	require.NoError(t, err)
+	require.False(t, d.NeedsRebuild())
+
+	for i := 0; i < 100; i++ {
+		idx := mustAlloc(t, d)
+		d.chunkForWrite(idx)[0] = byte(i)
+	}
+	d.Free(10)
+	d.Free(20)
+	require.NoError(t, d.Close())
+
+	d, err = OpenDatastore(path)
+	require.NoError(t, err)
+	require.False(t, d.NeedsRebuild())
+	require.Equal(t, uint32(100), d.NumChunks)
+	require.Equal(t, []uint32{10, 20}, d.FreeList)
+	for i := uint32(0); i < 100; i++ {
+		require.Equal(t, byte(i), d.Chunk(i)[0])
+	}
+
+	// Without Close, the free list has to be rebuilt.
+	require.NoError(t, d.Flush())
+	require.NoError(t, d.file.Close())
+	d, err = OpenDatastore(path)
+	require.NoError(t, err)
+	require.True(t, d.NeedsRebuild())
+	require.Empty(t, d.FreeList)
+
+	require.NoError(t, d.RebuildFreeList(func(mark func(idx uint32)) error {
+		for i := uint32(0); i < 100; i++ {
+			if i%2 == 0 {
+				mark(i)
+			}
+		}
+		return nil
+	}))
+	require.False(t, d.NeedsRebuild())
+	require.Len(t, d.FreeList, 50)
+	require.Equal(t, uint32(1), mustAlloc(t, d))
+	require.NoError(t, d.Close())
+}
+
+func TestDatastoreOutOfChunks(t *testing.T) {
+	d := New()
+	mustAlloc(t, d)
+	d.NumChunks = MaxChunks // pretend every other chunk is in use
+	require.Zero(t, d.Available())
+	_, err := d.Alloc()
+	require.ErrorIs(t, err, ErrOutOfChunks)
+
+	d.Free(0)
+	require.Equal(t, 1, d.Available())
+	require.Equal(t, uint32(0), mustAlloc(t, d))
+}
@@ -0,0 +1,67 @@
+package nomt
+
+import "sync/atomic"
+
+// epoch is a version of a tree published for readers.
+type epoch struct {
+	snapshot *Snapshot
+	readers  atomic.Int64
+}
+
+// View calls fn with a snapshot of the last version committed to the tree,
+// which fn may read until it returns. It can be called from any number of
+// goroutines while the tree is changed. It reports false, without calling fn,
+// unless the tree was created WithConcurrentReads.
+//
+// The snapshot is published once the commit is applied and hashed, before it
+// is flushed. The tree as it was when opened counts as committed.
+func (t *Tree) View(fn func(s *Snapshot)) bool {
+	for {
+		e := t.epoch.Load()
+		if e == nil {
+			return false
+		}
+		e.readers.Add(1)
+		// The writer releases retired epochs once they have no readers,
+		// so check that e was not retired before it was counted.
+		if t.epoch.Load() != e {
+			e.readers.Add(-1)
+			continue
+		}
+		defer e.readers.Add(-1)
+		fn(e.snapshot)
+		return true
+	}
+}
+
+// publish makes the tree's current version the one read by View,
+// releasing earlier ones no reader is in anymore.
+func (t *Tree) publish() {
+	if !t.concurrentReads {
+		return
+	}
+	if old := t.epoch.Swap(&epoch{snapshot: t.Snapshot()}); old != nil {
+		t.retired = append(t.retired, old)
+	}
+	kept := t.retired[:0]
+	for _, e := range t.retired {
+		if e.readers.Load() == 0 {
+			e.snapshot.Release()
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	clear(t.retired[len(kept):])
+	t.retired = kept
+}
+
+// retire stops publishing versions, releasing all of them.
+func (t *Tree) retire() {
+	if e := t.epoch.Swap(nil); e != nil {
+		t.retired = append(t.retired, e)
+	}
+	for _, e := range t.retired {
+		e.snapshot.Release()
+	}
+	t.retired = nil
+}
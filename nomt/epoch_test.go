@@ -0,0 +1,125 @@
+package nomt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestView(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	require.False(t, NewTree().View(func(*Snapshot) {}))
+
+	for _, dir := range []string{"", t.TempDir()} {
+		tr := NewTree(WithConcurrentReads())
+		if dir != "" {
+			var err error
+			tr, err = OpenTree(dir, WithConcurrentReads())
+			require.NoError(t, err)
+		}
+		// Every fifth batch is large enough to be hashed in parallel.
+		const numBatches = 20
+		bounds := []int{0}
+		for i := 1; i <= numBatches; i++ {
+			size := 100
+			if i%5 == 0 {
+				size = 2 * minParallelHashKeys
+			}
+			bounds = append(bounds, bounds[i-1]+size)
+		}
+		expected := NewTree()
+		roots := []Node{expected.Root()}
+		for i := 1; i <= numBatches; i++ {
+			root, err := expected.Commit(testBatch(bounds[i-1], bounds[i]))
+			require.NoError(t, err)
+			roots = append(roots, root)
+		}
+
+		// Readers report failures through errs, as require may only be
+		// called from the test's goroutine.
+		var wg sync.WaitGroup
+		var stop atomic.Bool
+		errs := make(chan error, 4)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for !stop.Load() {
+					var err error
+					if !tr.View(func(s *Snapshot) { err = checkView(s, roots, bounds) }) {
+						err = errors.New("View returned false")
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+
+		for i := 1; i <= numBatches; i++ {
+			batch := testBatch(bounds[i-1], bounds[i])
+			// Changes before the commit are not visible to readers.
+			for _, op := range batch.ops[:10] {
+				if !op.delete {
+					require.NoError(t, tr.Put(op.key, op.value))
+				}
+			}
+			tr.Root()
+			root, err := tr.Commit(batch)
+			require.NoError(t, err)
+			require.Equal(t, roots[i], root)
+		}
+		stop.Store(true)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+
+		require.NoError(t, tr.Close())
+		require.Empty(t, tr.snapshots)
+		require.Empty(t, tr.Datastore.refs)
+	}
+}
+
+// checkView checks that the snapshot is of a whole batch, proven against its root.
+func checkView(s *Snapshot, roots []Node, bounds []int) error {
+	root := s.Root()
+	n := slices.Index(roots, root)
+	if n < 0 {
+		return fmt.Errorf("unexpected root %x", root)
+	}
+	if n == 0 {
+		return nil
+	}
+	batch := testBatch(bounds[n-1], bounds[n])
+	final := make(map[string]batchOp)
+	for _, op := range batch.ops {
+		final[string(op.key)] = op
+	}
+	var valBuf [MaxInlineValueLen]byte
+	for _, op := range final {
+		val, ok := s.Get(op.key, valBuf[:])
+		if ok == op.delete || ok && !bytes.Equal(val, op.value) {
+			return fmt.Errorf("batch %d: key %x has value %q, %v", n, op.key, val, ok)
+		}
+	}
+	key := batch.ops[len(batch.ops)-1].key
+	proof, ok := s.Prove(key)
+	if !ok {
+		return fmt.Errorf("batch %d: no proof of key %x", n, key)
+	}
+	val, _ := s.Get(key, nil)
+	if !VerifyProof(root, key, val, proof) {
+		return fmt.Errorf("batch %d: proof of key %x does not verify", n, key)
+	}
+	return nil
+}
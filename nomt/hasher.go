@@ -0,0 +1,66 @@
+package nomt
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// Hasher computes the digests that internal nodes are made of.
+// Implementations must be safe for concurrent use.
+type Hasher interface {
+	// Hash returns the digest of data, the concatenated HashBytes of a node's children.
+	Hash(data []byte) [32]byte
+}
+
+// SHA3Hasher hashes with SHA3-256. It is the default Hasher.
+type SHA3Hasher struct{}
+
+func (SHA3Hasher) Hash(data []byte) [32]byte {
+	return sha3.Sum256(data)
+}
+
+// KeccakHasher hashes with the legacy Keccak-256, as used by Ethereum.
+type KeccakHasher struct{}
+
+func (KeccakHasher) Hash(data []byte) [32]byte {
+	// The state does not escape, so it is kept on the stack.
+	h := sha3.NewLegacyKeccak256()
+	h.Write(data)
+	var out [32]byte
+	h.Sum(out[:0])
+	return out
+}
+
+// SHA256Hasher hashes with SHA-256.
+type SHA256Hasher struct{}
+
+func (SHA256Hasher) Hash(data []byte) [32]byte {
+	return sha256.Sum256(data)
+}
+
+// hashBufPool holds the buffers data is copied to for hashers other than the built-in ones.
+var hashBufPool = sync.Pool{
+	New: func() any { return new([]byte) },
+}
+
+// hashWith returns h's digest of data. The built-in hashers are called
+// directly: data passed to Hash through the interface escapes to the heap,
+// which would make every buffer hashed on the stack an allocation.
+// Other hashers are given a pooled copy of data instead.
+func hashWith(h Hasher, data []byte) [32]byte {
+	switch h := h.(type) {
+	case SHA3Hasher:
+		return h.Hash(data)
+	case KeccakHasher:
+		return h.Hash(data)
+	case SHA256Hasher:
+		return h.Hash(data)
+	}
+	buf := hashBufPool.Get().(*[]byte)
+	*buf = append((*buf)[:0], data...)
+	out := h.Hash(*buf)
+	hashBufPool.Put(buf)
+	return out
+}
@@ -0,0 +1,162 @@
+package nomt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+)
+
+func TestHashers(t *testing.T) {
+	for _, tt := range []struct {
+		hasher     Hasher
+		empty, abc string
+	}{
+		{
+			hasher: SHA3Hasher{},
+			empty:  "a7ffc6f8bf1ed76651c14756a061d662f580ff4de43b49fa82d80a4b80f8434a",
+			abc:    "3a985da74fe225b2045c172d6bd390bd855f086e3e9d525b46bfe24511431532",
+		},
+		{
+			hasher: KeccakHasher{},
+			empty:  "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470",
+			abc:    "4e03657aea45a94fc7d47ba826c8d667c0d1e6e33a64a036ec44f58fa12d6c45",
+		},
+		{
+			hasher: SHA256Hasher{},
+			empty:  "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			abc:    "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		},
+	} {
+		empty := tt.hasher.Hash(nil)
+		require.Equal(t, tt.empty, hex.EncodeToString(empty[:]))
+		abc := tt.hasher.Hash([]byte("abc"))
+		require.Equal(t, tt.abc, hex.EncodeToString(abc[:]))
+	}
+}
+
+func TestWithHasher(t *testing.T) {
+	sha3Tree, _ := randomTree(100)
+	for _, hasher := range []Hasher{KeccakHasher{}, SHA256Hasher{}} {
+		tr, values := randomTree(100, WithHasher(hasher))
+		root := tr.Root()
+		require.NotEqual(t, sha3Tree.Root(), root)
+
+		for key, value := range values {
+			proof, ok := tr.Prove([]byte(key))
+			require.True(t, ok)
+			require.True(t, VerifyProof(root, []byte(key), value, proof, WithHasher(hasher)))
+			require.False(t, VerifyProof(root, []byte(key), value, proof))
+		}
+	}
+}
+
+func TestWithDomainSeparation(t *testing.T) {
+	// A tree with a single key holds its leaf in one of the root's children.
+	key, value := []byte{0x80}, []byte("value")
+	tr := NewTree(WithDomainSeparation())
+	tr.Put(key, value)
+	valueHash := sha3.Sum256(value)
+	leafHash := sha3.Sum256(append([]byte{0x00, 0x80}, valueHash[:]...))
+	preimage := append(append([]byte{0x01}, Zero[:]...), leafHash[:]...)
+	expected := Node(sha3.Sum256(preimage))
+	// As documented, the root has its most significant bit set.
+	expected[0] |= 0x80
+	require.Equal(t, expected, tr.Root())
+
+	tr, values := randomTree(1_000, WithDomainSeparation())
+	legacy, _ := randomTree(1_000)
+	root := tr.Root()
+	require.NotEqual(t, legacy.Root(), root)
+
+	var keys, vals [][]byte
+	for key, value := range values {
+		proof, ok := tr.Prove([]byte(key))
+		require.True(t, ok)
+		require.True(t, VerifyProof(root, []byte(key), value, proof, WithDomainSeparation()))
+		require.False(t, VerifyProof(root, []byte(key), value, proof))
+		keys = append(keys, []byte(key))
+	}
+	slices.SortFunc(keys, bytes.Compare)
+	for _, key := range keys {
+		vals = append(vals, values[string(key)])
+	}
+	multiProof, ok := tr.ProveMany(keys[:100])
+	require.True(t, ok)
+	require.True(t, VerifyMultiProof(root, keys[:100], vals[:100], multiProof, WithDomainSeparation()))
+
+	for i := 0; i < 100; i++ {
+		hash := sha3.Sum256([]byte(fmt.Sprintf("absent-%d", i)))
+		proof, ok := tr.ProveAbsent(hash[:])
+		require.True(t, ok)
+		require.True(t, VerifyAbsenceProof(root, hash[:], proof, WithDomainSeparation()))
+		require.False(t, VerifyAbsenceProof(root, hash[:], proof))
+	}
+
+	// Siblings must be hashes.
+	proof, _ := tr.Prove(keys[0])
+	proof.Siblings[0] = append(proof.Siblings[0], 0)
+	require.False(t, VerifyProof(root, keys[0], vals[0], proof, WithDomainSeparation()))
+}
+
+// sha3Func is a Hasher other than the built-in ones.
+type sha3Func func(data []byte) [32]byte
+
+func (f sha3Func) Hash(data []byte) [32]byte {
+	return f(data)
+}
+
+func TestHashAllocs(t *testing.T) {
+	for _, hasher := range []Hasher{SHA3Hasher{}, KeccakHasher{}, SHA256Hasher{}} {
+		c := &config{hasher: hasher}
+		// The buffer is declared in the function, so that it only
+		// allocates if hashing makes it escape.
+		require.Zero(t, testing.AllocsPerRun(100, func() {
+			var buf [2 * len(Node{})]byte
+			c.hashInternal(buf[:])
+		}), "%T", hasher)
+	}
+
+	// Other hashers hash a copy, giving the same digests.
+	data := []byte("abc")
+	require.Equal(t, SHA3Hasher{}.Hash(data), hashWith(sha3Func(sha3.Sum256), data))
+}
+
+func TestOpenTreeConfig(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := OpenTree(dir, WithHashedKeys())
+	require.NoError(t, err)
+	_, err = tr.Commit(testBatch(0, 100))
+	require.NoError(t, err)
+	root := tr.Root()
+	require.NoError(t, tr.Close())
+
+	for _, opts := range [][]Option{
+		nil,
+		{WithHashedKeys(), WithHasher(KeccakHasher{})},
+		{WithHashedKeys(), WithDomainSeparation()},
+	} {
+		_, err := OpenTree(dir, opts...)
+		require.ErrorIs(t, err, ErrConfigMismatch)
+	}
+
+	// Hashers are told apart by their digests, not their types.
+	tr, err = OpenTree(dir, WithHashedKeys(), WithHasher(sha3Func(sha3.Sum256)))
+	require.NoError(t, err)
+	require.Equal(t, root, tr.Root())
+	require.NoError(t, tr.Close())
+
+	// Trees created before options were saved take those they are opened with.
+	require.NoError(t, os.Remove(filepath.Join(dir, configFileName)))
+	tr, err = OpenTree(dir, WithHashedKeys())
+	require.NoError(t, err)
+	require.NoError(t, tr.Close())
+	_, err = OpenTree(dir)
+	require.ErrorIs(t, err, ErrConfigMismatch)
+}
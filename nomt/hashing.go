@@ -1,7 +1,12 @@
 package nomt
 
 import (
-	"golang.org/x/crypto/sha3"
+	"bytes"
+	"math"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
 )
 
 func commonPrefixBitLen(a, b []byte) int {
@@ -32,30 +37,260 @@ func commonPrefixBitLen(a, b []byte) int {
 	return i*8 + j
 }
 
+// maxHashBytesLen is the maximum length of the hash bytes of a node,
+// reached by a leaf with the longest key and inline value.
+const maxHashBytesLen = 2 + MaxHashedKeyLen + MaxInlineValueLen
+
+// path returns the bits that place key in the tree:
+// key itself, or its hash in trees created WithHashedKeys.
+func (c *config) path(key []byte) []byte {
+	if !c.hashedKeys {
+		return key
+	}
+	hash := c.hash(key)
+	return hash[:]
+}
+
+// hash returns the digest of data computed by the tree's Hasher.
+func (c *config) hash(data []byte) [32]byte {
+	return hashWith(c.hasher, data)
+}
+
+// maxKeyLen returns the maximum length of a key.
+func (c *config) maxKeyLen() int {
+	if c.hashedKeys {
+		return MaxHashedKeyLen
+	}
+	return MaxKeyLen
+}
+
+// Domain tags prefixed to the preimages of domain-separated hashes.
+const (
+	leafDomain     = 0x00
+	internalDomain = 0x01
+)
+
+// hashInternal returns the internal node whose children's
+// hash bytes (see hashBytes) are concatenated in data.
+func (c *config) hashInternal(data []byte) Node {
+	var node Node
+	if c.domainSeparated {
+		var buf [1 + 2*len(Node{})]byte
+		buf[0] = internalDomain
+		node = c.hash(buf[:1+copy(buf[1:], data)])
+	} else {
+		node = c.hash(data)
+	}
+	node.MarkInternal()
+	return node
+}
+
+// hashBytes writes the bytes standing for n in its parent's preimage to out
+// and returns their length. These are n's HashBytes, unless the tree is
+// domain separated, where a leaf is replaced by its leaf hash and an empty
+// node by 32 zero bytes.
+func (c *config) hashBytes(out []byte, n *Node, d *Datastore) int {
+	if !c.domainSeparated || n.IsHash() {
+		return n.HashBytes(out, d)
+	}
+	if n.IsZero() {
+		return copy(out, Zero[:])
+	}
+	var keyBuf [MaxHashedKeyLen]byte
+	var valueBuf [MaxInlineValueLen]byte
+	leaf := n.AsLeafNode()
+	key := leaf.GetKey(keyBuf[:], d)
+	var valueHash [32]byte
+	if leaf.isOverflow() {
+		valueHash = leaf.valueHash(d)
+	} else {
+		valueHash = c.hash(leaf.GetValue(valueBuf[:], d))
+	}
+	hash := c.leafHashOf(key, valueHash)
+	return copy(out, hash[:])
+}
+
+// leafHashBytes returns the hash bytes of a leaf holding key and value.
+func (c *config) leafHashBytes(key, value []byte) []byte {
+	if c.domainSeparated {
+		hash := c.leafHash(key, value)
+		return hash[:]
+	}
+	if len(value) > MaxInlineValueLen {
+		// Overflow values are replaced by their hash, as in Node.HashBytes.
+		valueHash := c.hash(value)
+		out := make([]byte, 0, 2+len(key)+len(valueHash))
+		out = append(out, overflowLeafPrefix, byte(len(key)))
+		out = append(out, key...)
+		return append(out, valueHash[:]...)
+	}
+	out := make([]byte, 0, 2+len(key)+len(value))
+	out = append(out, byte(len(key)), byte(len(value)))
+	out = append(out, key...)
+	return append(out, value...)
+}
+
+// emptyHashBytes returns the hash bytes of an empty node.
+func (c *config) emptyHashBytes() []byte {
+	if c.domainSeparated {
+		return Zero[:]
+	}
+	return []byte{0, 0}
+}
+
+// leafHash returns H(0x00||key||H(value)), the domain-separated hash of a leaf.
+func (c *config) leafHash(key, value []byte) [32]byte {
+	return c.leafHashOf(key, c.hash(value))
+}
+
+// leafHashOf is leafHash, given the hash of the value.
+func (c *config) leafHashOf(key []byte, valueHash [32]byte) [32]byte {
+	var buf [1 + MaxHashedKeyLen + len(Node{})]byte
+	buf[0] = leafDomain
+	pos := 1 + copy(buf[1:], key)
+	pos += copy(buf[pos:], valueHash[:])
+	return c.hash(buf[:pos])
+}
+
+// Root returns the root node of the tree, first rehashing the paths
+// of the keys changed by Put and Delete since they were last hashed.
+func (t *Tree) Root() Node {
+	if len(t.dirty) == 0 {
+		return t.root
+	}
+	paths := make([][]byte, 0, len(t.dirty))
+	for path := range t.dirty {
+		paths = append(paths, []byte(path))
+	}
+	slices.SortFunc(paths, bytes.Compare)
+	return t.hashPaths(paths)
+}
+
 // Hash returns the root node of a Merkle tree assuming
-// keys were updated. keys must be sorted lexicographically.
-func (t *Tree) Hash(keys [][]byte) Node {
+// keys were updated or deleted. keys must be sorted lexicographically.
+// Unlike Root, only the paths of the given keys are rehashed.
+// It returns ErrKeyTooLong or ErrUnsortedKeys, without hashing anything, for invalid keys.
+func (t *Tree) Hash(keys [][]byte) (Node, error) {
+	for i, key := range keys {
+		if len(key) > t.maxKeyLen() {
+			return t.root, ErrKeyTooLong
+		}
+		if i > 0 && bytes.Compare(keys[i-1], key) > 0 {
+			return t.root, ErrUnsortedKeys
+		}
+	}
+	if !t.hashedKeys {
+		return t.hashPaths(keys), nil
+	}
+	paths := make([][]byte, len(keys))
+	for i, key := range keys {
+		paths[i] = t.path(key)
+	}
+	slices.SortFunc(paths, bytes.Compare)
+	return t.hashPaths(paths), nil
+}
+
+// hashPaths is Hash, given the sorted paths of the keys.
+// In the functions below, keys stand for the paths of keys.
+func (t *Tree) hashPaths(keys [][]byte) Node {
+	if t.HashSplitDepth > 0 && len(keys) >= minParallelHashKeys {
+		t.hashParallel(keys, t.HashSplitDepth)
+	} else {
+		t.NumHashes += t.hashKeys(keys, -1, math.MaxInt)
+	}
+	for _, key := range keys {
+		delete(t.dirty, string(key))
+	}
+	return t.root
+}
+
+// Batches smaller than this are not worth hashing in parallel.
+const minParallelHashKeys = 256
+
+// hashParallel is Hash, with the nodes below splitDepth hashed concurrently.
+func (t *Tree) hashParallel(keys [][]byte, splitDepth int) {
+	// Group the keys by their first splitDepth bits. Nodes at splitDepth and below
+	// are only on the paths of keys in the same group, so each group can be
+	// hashed independently up to splitDepth.
+	var groups [][][]byte
+	start := 0
+	for i := 1; i <= len(keys); i++ {
+		if i == len(keys) || commonPrefixBitLen(keys[i-1], keys[i]) < splitDepth {
+			groups = append(groups, keys[start:i])
+			start = i
+		}
+	}
+
+	var numHashes atomic.Uint64
+	var wg sync.WaitGroup
+	work := make(chan [][]byte)
+	for i := 0; i < min(runtime.GOMAXPROCS(0), len(groups)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range work {
+				numHashes.Add(t.hashKeys(group, splitDepth-1, math.MaxInt))
+			}
+		}()
+	}
+	for _, group := range groups {
+		work <- group
+	}
+	close(work)
+	wg.Wait()
+
+	// Then hash the nodes above splitDepth, once for each group.
+	first := make([][]byte, len(groups))
+	for i, group := range groups {
+		first[i] = group[0]
+	}
+	t.NumHashes += numHashes.Load() + t.hashKeys(first, -1, splitDepth)
+}
+
+// hashKeys rehashes the paths of keys, which must be sorted lexicographically,
+// stopping before the nodes at or above stopDepth and starting no deeper than maxDepth.
+// It returns the number of nodes hashed.
+func (t *Tree) hashKeys(keys [][]byte, stopDepth, maxDepth int) uint64 {
+	var numHashes uint64
 	for i := 0; i < len(keys); i++ {
-		hashFrom := 0 // root node
+		hashFrom := stopDepth
 		if i+1 < len(keys) {
 			// if there is any common prefix, from the nodes from
 			// the root up to the common prefix will get updated
 			// with the next key.
-			hashFrom = commonPrefixBitLen(keys[i], keys[i+1])
+			hashFrom = max(hashFrom, commonPrefixBitLen(keys[i], keys[i+1]))
 		}
-		t.hash(keys[i], hashFrom)
+		numHashes += t.hash(keys[i], hashFrom, maxDepth)
 	}
-	return t.Root
+	return numHashes
 }
 
-func (t *Tree) hash(key []byte, hashFrom int) {
+// hash rehashes the nodes above the one key's path ends at, or above the node at
+// maxDepth on that path if it is deeper, stopping before the first node at or above
+// depth hashFrom. A negative hashFrom rehashes up to the root.
+// It returns the number of nodes hashed.
+func (t *Tree) hash(key []byte, hashFrom, maxDepth int) uint64 {
 	var paddedKeyBuf [MaxKeyLenPadded]byte
 	paddedKey := paddedKeyBuf[:]
 	paddedKey, partialBits := PadKey(key, paddedKey)
 	pageIdx, pathLen, page := t.lookup(paddedKey, partialBits)
 
-	// pathLen == 0 is not valid (key must be in the tree).
+	// If key was deleted, start from the empty slot it left behind
+	// so that every node above it is rehashed. A key whose path is taken by
+	// internal nodes all the way was never stored, and there is no slot below
+	// the last of them: the nodes above it are rehashed instead.
+	if pathLen == 0 || page.Nodes[indexOf(paddedKey[pageIdx], pathLen)].IsHash() &&
+		fullBits*pageIdx+int(pathLen) < pathDepth(paddedKey, partialBits) {
+		pathLen++
+	}
+	if fullBits*pageIdx+int(pathLen) > maxDepth {
+		pageIdx = (maxDepth - 1) / fullBits
+		pathLen = byte(maxDepth - fullBits*pageIdx)
+		page = t.page(paddedKey[:pageIdx])
+	}
+	page = t.pageForWrite(paddedKey[:pageIdx], page)
 
+	var numHashes uint64
 	nodeIdx := indexOf(paddedKey[pageIdx], pathLen)
 	node := &page.Nodes[nodeIdx]
 
@@ -78,17 +313,17 @@ func (t *Tree) hash(key []byte, hashFrom int) {
 		pathLen--
 
 		// If we reached hashFrom, we are done.
-		if hashFrom > 0 && 6*pageIdx+int(pathLen) <= hashFrom {
+		if 6*pageIdx+int(pathLen) <= hashFrom {
 			break
 		}
 
 		if pathLen == 0 && pageIdx > 0 {
 			// Need to walk back one page.
 			pageIdx--
-			page = t.Pages[string(paddedKey[:pageIdx])]
+			page = t.pageForWrite(paddedKey[:pageIdx], t.page(paddedKey[:pageIdx]))
 			pathLen = fullBits
 		}
-		parent := &t.Root
+		parent := &t.root
 		parentIdx := 0
 		atRoot := pageIdx == 0 && pathLen == 0
 		if !atRoot {
@@ -96,14 +331,19 @@ func (t *Tree) hash(key []byte, hashFrom int) {
 			parent = &page.Nodes[parentIdx]
 		}
 
-		var hashBytesBuf [2 + MaxKeyLen + MaxValueLen]byte
+		if atRoot && node0.IsZero() && node1.IsZero() {
+			// The tree is empty.
+			t.root = Zero
+			break
+		}
+
+		var hashBytesBuf [2 * maxHashBytesLen]byte
 		hashBytes := hashBytesBuf[:]
-		pos := node0.HashBytes(hashBytes, t.Datastore)
-		pos += node1.HashBytes(hashBytes[pos:], t.Datastore)
+		pos := t.hashBytes(hashBytes, node0, t.Datastore)
+		pos += t.hashBytes(hashBytes[pos:], node1, t.Datastore)
 
-		*parent = sha3.Sum256(hashBytes[:pos])
-		parent.MarkInternal()
-		t.NumHashes++
+		*parent = t.hashInternal(hashBytes[:pos])
+		numHashes++
 
 		if atRoot {
 			break
@@ -111,4 +351,5 @@ func (t *Tree) hash(key []byte, hashFrom int) {
 		node = parent
 		nodeIdx = parentIdx
 	}
+	return numHashes
 }
@@ -0,0 +1,149 @@
+package nomt
+
+import "errors"
+
+// Version returns the number of batches committed to the tree,
+// which is the version of its last commit.
+func (t *Tree) Version() uint64 {
+	return t.version
+}
+
+// commitVersion numbers a commit that was just applied, keeping a snapshot
+// of it WithHistory and publishing it WithConcurrentReads.
+func (t *Tree) commitVersion() {
+	t.version++
+	defer t.publish()
+	if t.historyLen <= 0 {
+		return
+	}
+	t.history = append(t.history, t.Snapshot())
+	t.pruneHistory(t.historyLen)
+}
+
+// pruneHistory releases all but the last keep versions.
+func (t *Tree) pruneHistory(keep int) {
+	n := max(len(t.history)-keep, 0)
+	for _, s := range t.history[:n] {
+		s.Release()
+	}
+	t.history = append(t.history[:0], t.history[n:]...)
+}
+
+// at returns the snapshot of version, or nil if it is not kept.
+func (t *Tree) at(version uint64) *Snapshot {
+	oldest := t.version + 1 - uint64(len(t.history))
+	if version < oldest || version > t.version {
+		return nil
+	}
+	return t.history[version-oldest]
+}
+
+// RootAt returns the root of the tree after the commit with the given version,
+// or false if the version is not kept.
+func (t *Tree) RootAt(version uint64) (Node, bool) {
+	s := t.at(version)
+	if s == nil {
+		return Node{}, false
+	}
+	return s.Root(), true
+}
+
+// GetAt is Get, for the tree as of the given version.
+// It returns false if the version is not kept.
+func (t *Tree) GetAt(version uint64, key []byte, valBuf []byte) ([]byte, bool) {
+	s := t.at(version)
+	if s == nil {
+		return nil, false
+	}
+	return s.Get(key, valBuf)
+}
+
+// ProveAt is Prove, for the root returned by RootAt.
+// It returns false if the version is not kept.
+func (t *Tree) ProveAt(version uint64, key []byte) (*Proof, bool) {
+	s := t.at(version)
+	if s == nil {
+		return nil, false
+	}
+	return s.Prove(key)
+}
+
+// ErrVersionNotKept is returned when rolling back to a version that is not in the history.
+var ErrVersionNotKept = errors.New("nomt: version not kept")
+
+// Rollback reverts the last n commits, along with any changes made since the
+// last one, and returns the root of the version it reverts to. That version
+// must be kept WithHistory, or ErrVersionNotKept is returned. The versions
+// after it are dropped, and new commits are numbered from it.
+//
+// The snapshot kept for each version holds the pages the tree replaced since,
+// which make up the version's undo log: they are put back in the tree, the
+// chunks of the pages they replace are freed, and the chunks they reference
+// are handed back to the tree. For trees opened with OpenTree, the rollback is
+// logged and flushed like a commit.
+func (t *Tree) Rollback(n int) (Node, error) {
+	if n < 0 || uint64(n) > t.version {
+		return t.root, ErrVersionNotKept
+	}
+	version := t.version - uint64(n)
+	s := t.at(version)
+	if s == nil {
+		return t.root, ErrVersionNotKept
+	}
+	for _, later := range t.history[len(t.history)-n:] {
+		later.Release()
+	}
+	t.history = t.history[:len(t.history)-n]
+	t.revert(s)
+	t.version = version
+	t.publish()
+	return t.root, t.persist(&Batch{})
+}
+
+// RevertTo rolls back to the last kept version with the given root,
+// returning ErrVersionNotKept if there is none.
+func (t *Tree) RevertTo(root Node) error {
+	for i := len(t.history) - 1; i >= 0; i-- {
+		if t.history[i].Root() == root {
+			_, err := t.Rollback(len(t.history) - 1 - i)
+			return err
+		}
+	}
+	return ErrVersionNotKept
+}
+
+// revert puts the pages saved by s back in the tree, leaving s to read them from the tree.
+func (t *Tree) revert(s *Snapshot) {
+	t.snapshotMu.Lock()
+	defer t.snapshotMu.Unlock()
+	d := t.Datastore
+	for path, page := range s.pages.saved {
+		// Snapshots taken since s may still read the current page.
+		current := t.Pages.Page([]byte(path))
+		preserved := t.preserve([]byte(path), current)
+		if current != nil {
+			current.chunks(d, d.Free)
+		}
+		if page == nil {
+			t.Pages.Delete([]byte(path))
+		} else {
+			t.Pages.Put([]byte(path), page)
+		}
+		if current != nil && !preserved {
+			t.freePage(current)
+		}
+		// Pages in the tree must not be saved by a snapshot, which would
+		// keep them from being copied before being changed.
+		for _, other := range t.snapshots {
+			if saved, ok := other.saved[path]; ok && other != s.pages && saved == page {
+				delete(other.saved, path)
+				if page != nil {
+					page.chunks(d, d.Free)
+				}
+			}
+		}
+	}
+	clear(s.pages.saved)
+	t.root = s.Root()
+	clear(t.dirty)
+}
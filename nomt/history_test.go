@@ -0,0 +1,153 @@
+package nomt
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+)
+
+func TestHistory(t *testing.T) {
+	const window = 3
+	tr := NewTree(WithHistory(window))
+	key := sha3.Sum256([]byte("key-0"))
+
+	roots := make(map[uint64]Node)
+	for version := uint64(1); version <= 10; version++ {
+		batch := testBatch(int(version-1)*100, int(version)*100)
+		batch.Put(key[:], snapshotTestValue(50, int(version)))
+		root, err := tr.Commit(batch)
+		require.NoError(t, err)
+		require.Equal(t, version, tr.Version())
+		roots[version] = root
+		require.LessOrEqual(t, len(tr.snapshots), window)
+	}
+
+	for version := uint64(0); version <= 11; version++ {
+		root, ok := tr.RootAt(version)
+		val, _ := tr.GetAt(version, key[:], nil)
+		proof, _ := tr.ProveAt(version, key[:])
+		if version <= 10-window || version > 10 {
+			// Pruned, or not committed yet.
+			require.False(t, ok)
+			require.Nil(t, val)
+			require.Nil(t, proof)
+			continue
+		}
+		require.True(t, ok)
+		require.Equal(t, roots[version], root)
+		require.Equal(t, snapshotTestValue(50, int(version)), val)
+		require.True(t, VerifyProof(root, key[:], val, proof))
+
+		// Keys from later batches were not there yet.
+		later := sha3.Sum256([]byte(fmt.Sprintf("key-%d", version*100+1)))
+		_, ok = tr.GetAt(version, later[:], nil)
+		require.False(t, ok)
+		_, ok = tr.Get(later[:], nil)
+		require.Equal(t, version < 10, ok)
+	}
+
+	// Once the history is dropped, only the tree's chunks are in use.
+	require.NoError(t, tr.Close())
+	require.Empty(t, tr.Datastore.refs)
+	marked := 0
+	require.NoError(t, tr.markChunks(func(uint32) { marked++ }))
+	require.Equal(t, marked, tr.Datastore.InUse())
+}
+
+func TestHistoryReopen(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := OpenTree(dir, WithHistory(2))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := tr.Commit(testBatch(i*100, (i+1)*100))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tr.Close())
+
+	// The version is kept, but the history is not.
+	tr, err = OpenTree(dir, WithHistory(2))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), tr.Version())
+	_, ok := tr.RootAt(3)
+	require.False(t, ok)
+
+	root, err := tr.Commit(testBatch(300, 400))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), tr.Version())
+	rootAt, ok := tr.RootAt(4)
+	require.True(t, ok)
+	require.Equal(t, root, rootAt)
+	require.NoError(t, tr.Close())
+}
+
+func TestRollback(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		tr := NewTree(WithHistory(4))
+		if dir != "" {
+			var err error
+			tr, err = OpenTree(dir, WithHistory(4))
+			require.NoError(t, err)
+		}
+		var roots []Node
+		for i := 0; i < 6; i++ {
+			root, err := tr.Commit(testBatch(i*100, (i+1)*100))
+			require.NoError(t, err)
+			roots = append(roots, root)
+		}
+		// Uncommitted changes are discarded too.
+		require.NoError(t, tr.Put([]byte("uncommitted"), []byte("value")))
+		snapshot := tr.Snapshot()
+
+		_, err := tr.Rollback(4)
+		require.ErrorIs(t, err, ErrVersionNotKept)
+		root, err := tr.Rollback(2)
+		require.NoError(t, err)
+		require.Equal(t, roots[3], root)
+		require.Equal(t, roots[3], tr.Root())
+		require.Equal(t, uint64(4), tr.Version())
+		requireBatch(t, tr, testBatch(300, 400), true)
+		requireBatch(t, tr, testBatch(400, 500), false)
+		_, ok := tr.Get([]byte("uncommitted"), nil)
+		require.False(t, ok)
+		_, ok = tr.RootAt(5)
+		require.False(t, ok)
+
+		// Snapshots taken before the rollback are unaffected.
+		val, ok := snapshot.Get([]byte("uncommitted"), nil)
+		require.True(t, ok)
+		require.Equal(t, []byte("value"), val)
+		snapshot.Release()
+
+		// The tree can be committed to as if the rolled back commits never happened.
+		expected := NewTree()
+		for i := 0; i < 4; i++ {
+			_, err := expected.Commit(testBatch(i*100, (i+1)*100))
+			require.NoError(t, err)
+		}
+		batch := testBatch(1_000, 1_100)
+		root, err = tr.Commit(batch)
+		require.NoError(t, err)
+		expectedRoot, err := expected.Commit(batch)
+		require.NoError(t, err)
+		require.Equal(t, expectedRoot, root)
+
+		require.NoError(t, tr.RevertTo(roots[2]))
+		require.Equal(t, roots[2], tr.Root())
+		require.ErrorIs(t, tr.RevertTo(roots[5]), ErrVersionNotKept)
+
+		require.NoError(t, tr.Close())
+		if dir != "" {
+			tr, err = OpenTree(dir)
+			require.NoError(t, err)
+			require.Equal(t, roots[2], tr.Root())
+			require.Equal(t, uint64(3), tr.Version())
+			requireBatch(t, tr, testBatch(200, 300), true)
+		}
+		marked := 0
+		require.NoError(t, tr.markChunks(func(uint32) { marked++ }))
+		require.Equal(t, marked, tr.Datastore.InUse())
+		require.NoError(t, tr.Close())
+	}
+}
@@ -0,0 +1,304 @@
+package nomt
+
+import (
+	"bytes"
+)
+
+// Iterator walks the keys and values of a Tree in order.
+// Keys are visited in the order of their paths, which for most trees is
+// lexicographic order. In trees created WithHashedKeys, keys are visited in
+// the order of their hashes, and bounds and seek targets are hashes too.
+//
+// An Iterator starts out unpositioned: call First, Last, SeekGE or SeekLT before
+// reading it. The tree must not be modified while an Iterator is in use.
+type Iterator struct {
+	t          *Tree
+	start, end []byte // bounds: start is inclusive, end exclusive; nil for none
+
+	// The node the iterator is at, found at depth on path.
+	// The root is at depth 0, where node is nil.
+	path  []byte
+	depth int
+	node  *Node
+	floor int // depth of the subtree the iterator is confined to
+
+	valid    bool
+	keyBuf   [MaxHashedKeyLen]byte
+	key      []byte
+	valueBuf []byte
+}
+
+// Iterator returns an iterator over the keys in [start, end).
+// A nil start or end leaves that side of the range unbounded.
+func (t *Tree) Iterator(start, end []byte) *Iterator {
+	return &Iterator{
+		t:     t,
+		start: start,
+		end:   end,
+		path:  make([]byte, MaxKeyLenPadded),
+	}
+}
+
+// Valid reports whether the iterator is at a key.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key the iterator is at, or nil if it is not Valid.
+// It is only valid until the iterator is moved.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value of the key the iterator is at, or nil if it is not Valid.
+// It is only valid until the iterator is moved.
+func (it *Iterator) Value() []byte {
+	if !it.valid {
+		return nil
+	}
+	it.valueBuf = it.node.AsLeafNode().GetValue(it.valueBuf, it.t.Datastore)
+	return it.valueBuf
+}
+
+// First moves the iterator to the first key in its range and reports whether there is one.
+func (it *Iterator) First() bool {
+	if it.start != nil {
+		return it.SeekGE(it.start)
+	}
+	it.depth, it.node = 0, nil
+	return it.descend(false) && it.checkEnd()
+}
+
+// Last moves the iterator to the last key in its range and reports whether there is one.
+func (it *Iterator) Last() bool {
+	if it.end != nil {
+		return it.SeekLT(it.end)
+	}
+	it.depth, it.node = 0, nil
+	return it.descend(true) && it.checkStart()
+}
+
+// Next moves the iterator to the next key and reports whether there is one.
+// Once it has moved past either end of its range, it must be repositioned.
+func (it *Iterator) Next() bool {
+	return it.valid && it.step(false) && it.checkEnd()
+}
+
+// Prev moves the iterator to the previous key and reports whether there is one.
+// Once it has moved past either end of its range, it must be repositioned.
+func (it *Iterator) Prev() bool {
+	return it.valid && it.step(true) && it.checkStart()
+}
+
+// SeekGE moves the iterator to the first key at or after target
+// and reports whether there is one in its range.
+func (it *Iterator) SeekGE(target []byte) bool {
+	if it.start != nil && bytes.Compare(target, it.start) < 0 {
+		target = it.start
+	}
+	if !it.seek(target, false) {
+		return it.invalidate()
+	}
+	for bytes.Compare(it.keyPath(), target) < 0 {
+		if !it.step(false) {
+			return false
+		}
+	}
+	return it.checkEnd()
+}
+
+// SeekLT moves the iterator to the last key before target
+// and reports whether there is one in its range.
+func (it *Iterator) SeekLT(target []byte) bool {
+	if it.end != nil && bytes.Compare(target, it.end) > 0 {
+		target = it.end
+	}
+	if !it.seek(target, true) {
+		return it.invalidate()
+	}
+	for bytes.Compare(it.keyPath(), target) >= 0 {
+		if !it.step(true) {
+			return false
+		}
+	}
+	return it.checkStart()
+}
+
+// keyPath returns the path of the key the iterator is at.
+func (it *Iterator) keyPath() []byte {
+	return it.t.path(it.key)
+}
+
+func (it *Iterator) checkEnd() bool {
+	if it.end != nil && bytes.Compare(it.keyPath(), it.end) >= 0 {
+		return it.invalidate()
+	}
+	return true
+}
+
+func (it *Iterator) checkStart() bool {
+	if it.start != nil && bytes.Compare(it.keyPath(), it.start) < 0 {
+		return it.invalidate()
+	}
+	return true
+}
+
+func (it *Iterator) invalidate() bool {
+	it.valid = false
+	it.key = nil
+	return false
+}
+
+// seek moves the iterator to the node target's path ends at, as found by lookup,
+// and from there to a nearby leaf: the next one, or the previous one if reverse.
+// Keys between the leaf and target must then be skipped by the caller.
+func (it *Iterator) seek(target []byte, reverse bool) bool {
+	if n := (len(target)*8+5)/6 + 1; len(it.path) < n {
+		it.path = make([]byte, n)
+	}
+	clear(it.path) // PadKey leaves the byte after a multiple of 3 bytes unset
+	paddedKey, partialBits := PadKey(target, it.path)
+	pageIdx, pathLen, _ := it.t.lookup(paddedKey, partialBits)
+	it.depth = fullBits*pageIdx + int(pathLen)
+	if it.depth > 0 {
+		// This is in the parent page if pathLen is 0.
+		it.node = it.nodeAt(it.depth)
+	}
+	switch {
+	case it.depth > 0 && !it.node.IsHash():
+		it.loadKey()
+		return true
+	case it.depth == pathDepth(paddedKey, partialBits):
+		// The keys below share target's whole path.
+		return it.descend(reverse)
+	default:
+		// Stop at the empty slot below, which is on no key's path.
+		it.depth++
+		it.node = it.nodeAt(it.depth)
+		return it.step(reverse)
+	}
+}
+
+// step moves the iterator from its node to the next leaf in key order,
+// or to the previous one if reverse.
+func (it *Iterator) step(reverse bool) bool {
+	from, to := byte(0), byte(1)
+	if reverse {
+		from, to = 1, 0
+	}
+	// Go up until there is a sibling to visit.
+	for depth := it.depth; depth > it.floor; depth-- {
+		if it.bit(depth) != from {
+			continue
+		}
+		it.setBit(depth, to)
+		if node := it.nodeAt(depth); !node.IsZero() {
+			it.depth, it.node = depth, node
+			return it.descend(reverse)
+		}
+	}
+	return it.invalidate()
+}
+
+// descend moves the iterator from its node, which must not be empty,
+// to the first leaf below it, or the last one if reverse.
+func (it *Iterator) descend(reverse bool) bool {
+	first := byte(0)
+	if reverse {
+		first = 1
+	}
+	for it.depth == 0 || it.node.IsHash() {
+		// Internal nodes have at least one non-empty child.
+		it.depth++
+		it.setBit(it.depth, first)
+		it.node = it.nodeAt(it.depth)
+		if it.node.IsZero() {
+			it.setBit(it.depth, first^1)
+			it.node = it.nodeAt(it.depth)
+			if it.node.IsZero() {
+				// Only the root of an empty tree has no children.
+				return it.invalidate()
+			}
+		}
+	}
+	it.loadKey()
+	return true
+}
+
+func (it *Iterator) loadKey() {
+	it.valid = true
+	it.key = it.node.AsLeafNode().GetKey(it.keyBuf[:], it.t.Datastore)
+}
+
+// nodeAt returns the node at depth (> 0) on the iterator's path.
+func (it *Iterator) nodeAt(depth int) *Node {
+	pageIdx := (depth - 1) / fullBits
+	page := it.t.Pages.Page(it.path[:pageIdx])
+	return &page.Nodes[indexOf(it.path[pageIdx], byte(depth-fullBits*pageIdx))]
+}
+
+// bit returns the bit of the iterator's path leading to the node at depth (> 0).
+func (it *Iterator) bit(depth int) byte {
+	return pathBit(it.path, depth-1)
+}
+
+// setBit sets the bit of the iterator's path leading to the node at depth (> 0),
+// clearing the bits after it in the same byte.
+func (it *Iterator) setBit(depth int, bit byte) {
+	shift := fullBits - 1 - (depth-1)%fullBits
+	b := &it.path[(depth-1)/fullBits]
+	*b = *b&^(1<<(shift+1)-1) | bit<<shift
+}
+
+// ScanPrefix calls fn, in order, for each key starting with prefix and its value,
+// until fn returns false. The key and value are only valid during the call.
+//
+// Only the subtree holding the keys with prefix is visited, except in trees
+// created WithHashedKeys, where such keys are spread over the whole tree.
+func (t *Tree) ScanPrefix(prefix []byte, fn func(key, value []byte) bool) {
+	if t.hashedKeys {
+		it := t.Iterator(nil, nil)
+		for ok := it.First(); ok; ok = it.Next() {
+			if bytes.HasPrefix(it.Key(), prefix) && !fn(it.Key(), it.Value()) {
+				return
+			}
+		}
+		return
+	}
+	if len(prefix) > MaxKeyLen {
+		return
+	}
+
+	// The keys with prefix are below the node at depth on the prefix's path.
+	depth := 8 * len(prefix)
+	it := t.Iterator(nil, nil)
+	it.floor = depth
+	if depth > 0 {
+		// Unlike PadKey, end the path exactly after the prefix.
+		paddedKey, _ := PadKey(prefix, it.path)
+		paddedKey = paddedKey[:(depth+fullBits-1)/fullBits]
+		pageIdx, pathLen, _ := t.lookup(paddedKey, fullBits*len(paddedKey)-depth)
+		it.depth = fullBits*pageIdx + int(pathLen)
+		if it.depth == 0 {
+			return
+		}
+		it.node = it.nodeAt(it.depth)
+		if !it.node.IsHash() {
+			// A single leaf is on the path, which may not have the prefix.
+			it.loadKey()
+			if bytes.HasPrefix(it.key, prefix) {
+				fn(it.key, it.Value())
+			}
+			return
+		}
+		if it.depth < depth {
+			// The path leaves the tree before reaching the prefix's subtree.
+			return
+		}
+	}
+	for ok := it.descend(false); ok; ok = it.step(false) {
+		if !fn(it.key, it.Value()) {
+			return
+		}
+	}
+}
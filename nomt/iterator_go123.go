@@ -0,0 +1,30 @@
+//go:build go1.23
+
+package nomt
+
+import "iter"
+
+// All returns an iterator over the keys and values in [start, end), in order.
+// The key and value passed to the loop body are only valid for that iteration.
+func (t *Tree) All(start, end []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, value []byte) bool) {
+		it := t.Iterator(start, end)
+		for ok := it.First(); ok; ok = it.Next() {
+			if !yield(it.Key(), it.Value()) {
+				return
+			}
+		}
+	}
+}
+
+// Backward is All, in reverse order.
+func (t *Tree) Backward(start, end []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, value []byte) bool) {
+		it := t.Iterator(start, end)
+		for ok := it.Last(); ok; ok = it.Prev() {
+			if !yield(it.Key(), it.Value()) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+//go:build go1.23
+
+package nomt
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAll(t *testing.T) {
+	tr, paths, values := iteratorTestTree(t)
+
+	var got [][]byte
+	for key, value := range tr.All(nil, nil) {
+		require.Equal(t, values[string(key)], value)
+		got = append(got, bytes.Clone(key))
+	}
+	require.Equal(t, paths, got)
+
+	got = got[:0]
+	for key := range tr.Backward(paths[10], paths[20]) {
+		got = append(got, bytes.Clone(key))
+	}
+	slices.Reverse(got)
+	require.Equal(t, paths[10:20], got)
+
+	// Stopping early.
+	for key := range tr.All(paths[5], nil) {
+		require.Equal(t, paths[5], key)
+		break
+	}
+}
@@ -0,0 +1,198 @@
+package nomt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// iteratorTestTree returns a tree holding keys of varying lengths, some of
+// them prefixes of others, along with its keys in order.
+func iteratorTestTree(t *testing.T, opts ...Option) (*Tree, [][]byte, map[string][]byte) {
+	r := rand.New(rand.NewSource(1))
+	tr := NewTree(opts...)
+	values := make(map[string][]byte)
+	for i := 0; i < 2_000; i++ {
+		key := make([]byte, 1+r.Intn(8))
+		r.Read(key)
+		value := []byte(fmt.Sprintf("value-%d", i))
+		if tr.Put(key, value) == nil {
+			values[string(key)] = value
+		}
+	}
+	// Leave some internal nodes with a single child.
+	for key := range values {
+		if r.Intn(4) == 0 {
+			require.True(t, tr.Delete([]byte(key)))
+			delete(values, key)
+		}
+	}
+	var paths [][]byte
+	for key := range values {
+		paths = append(paths, tr.path([]byte(key)))
+	}
+	slices.SortFunc(paths, bytes.Compare)
+	return tr, paths, values
+}
+
+func TestIterator(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithHashedKeys()}} {
+		tr, paths, values := iteratorTestTree(t, opts...)
+
+		var got [][]byte
+		it := tr.Iterator(nil, nil)
+		require.False(t, it.Valid())
+		require.Nil(t, it.Key())
+		require.Nil(t, it.Value())
+		for ok := it.First(); ok; ok = it.Next() {
+			require.Equal(t, values[string(it.Key())], it.Value())
+			got = append(got, bytes.Clone(tr.path(it.Key())))
+		}
+		require.Equal(t, paths, got)
+		require.False(t, it.Valid())
+		require.Nil(t, it.Key())
+		require.Nil(t, it.Value())
+
+		got = got[:0]
+		for ok := it.Last(); ok; ok = it.Prev() {
+			got = append(got, bytes.Clone(tr.path(it.Key())))
+		}
+		slices.Reverse(got)
+		require.Equal(t, paths, got)
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	tr, paths, _ := iteratorTestTree(t)
+	it := tr.Iterator(nil, nil)
+	for i := 0; i < 1_000; i++ {
+		target := make([]byte, r.Intn(10))
+		r.Read(target)
+		if i%2 == 0 {
+			// Seek to existing keys and their neighbors.
+			target = bytes.Clone(paths[r.Intn(len(paths))])
+			target = target[:r.Intn(len(target)+1)]
+		}
+
+		idx := sort.Search(len(paths), func(i int) bool { return bytes.Compare(paths[i], target) >= 0 })
+		if idx < len(paths) {
+			require.True(t, it.SeekGE(target))
+			require.Equal(t, paths[idx], it.Key(), "target %x", target)
+			if idx+1 < len(paths) {
+				require.True(t, it.Next())
+				require.Equal(t, paths[idx+1], it.Key())
+			}
+		} else {
+			require.False(t, it.SeekGE(target))
+		}
+
+		if idx > 0 {
+			require.True(t, it.SeekLT(target))
+			require.Equal(t, paths[idx-1], it.Key(), "target %x", target)
+			if idx > 1 {
+				require.True(t, it.Prev())
+				require.Equal(t, paths[idx-2], it.Key())
+			}
+		} else {
+			require.False(t, it.SeekLT(target))
+		}
+	}
+}
+
+func TestIteratorBounds(t *testing.T) {
+	tr, paths, _ := iteratorTestTree(t)
+	start, end := paths[100], paths[200]
+	it := tr.Iterator(start, end)
+
+	var got [][]byte
+	for ok := it.First(); ok; ok = it.Next() {
+		got = append(got, bytes.Clone(it.Key()))
+	}
+	require.Equal(t, paths[100:200], got)
+
+	got = got[:0]
+	for ok := it.Last(); ok; ok = it.Prev() {
+		got = append(got, bytes.Clone(it.Key()))
+	}
+	slices.Reverse(got)
+	require.Equal(t, paths[100:200], got)
+
+	require.True(t, it.SeekGE(paths[0]))
+	require.Equal(t, start, it.Key())
+	require.False(t, it.SeekGE(end))
+	require.True(t, it.SeekLT(paths[300]))
+	require.Equal(t, paths[199], it.Key())
+	require.False(t, it.SeekLT(start))
+}
+
+func TestIteratorEmpty(t *testing.T) {
+	tr := NewTree()
+	it := tr.Iterator(nil, nil)
+	require.False(t, it.First())
+	require.False(t, it.Last())
+	require.False(t, it.SeekGE([]byte("key")))
+	require.False(t, it.SeekLT([]byte("key")))
+
+	tr.Put([]byte("key"), []byte("value"))
+	require.True(t, it.First())
+	require.Equal(t, []byte("key"), it.Key())
+	require.Equal(t, []byte("value"), it.Value())
+	require.False(t, it.Next())
+	require.True(t, it.Last())
+	require.Equal(t, []byte("key"), it.Key())
+	require.False(t, it.Prev())
+}
+
+func TestScanPrefix(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	for _, opts := range [][]Option{nil, {WithHashedKeys()}} {
+		tr, _, values := iteratorTestTree(t, opts...)
+		var keys [][]byte
+		for key := range values {
+			keys = append(keys, []byte(key))
+		}
+		slices.SortFunc(keys, bytes.Compare)
+
+		for i := 0; i < 300; i++ {
+			prefix := bytes.Clone(keys[r.Intn(len(keys))])
+			prefix = prefix[:r.Intn(min(len(prefix), 3)+1)]
+			if i%10 == 0 {
+				prefix = append(prefix, byte(r.Intn(256)))
+			}
+
+			var expected [][]byte
+			for _, key := range keys {
+				if bytes.HasPrefix(key, prefix) {
+					expected = append(expected, key)
+				}
+			}
+			var got [][]byte
+			tr.ScanPrefix(prefix, func(key, value []byte) bool {
+				require.Equal(t, values[string(key)], value)
+				got = append(got, bytes.Clone(key))
+				return true
+			})
+			if opts == nil {
+				require.Equal(t, expected, got, "prefix %x", prefix)
+			} else {
+				// Keys are visited in the order of their hashes.
+				slices.SortFunc(got, bytes.Compare)
+				require.Equal(t, expected, got, "prefix %x", prefix)
+			}
+		}
+
+		// Stopping early.
+		var n int
+		tr.ScanPrefix(nil, func(key, value []byte) bool {
+			n++
+			return n < 10
+		})
+		require.Equal(t, 10, n)
+	}
+}
@@ -0,0 +1,202 @@
+package nomt
+
+import (
+	"bytes"
+	"sort"
+)
+
+// MultiProof is a Merkle inclusion proof for several keys at once.
+// Siblings shared by the paths of more than one key are included only once,
+// and nodes on the path of some key are never included.
+type MultiProof struct {
+	// Depths holds the depth of each key's leaf, in the order of the keys.
+	Depths []int
+	// Siblings holds the hash bytes of the siblings off the keys' paths,
+	// in the order a depth-first walk of the keys needs them.
+	Siblings [][]byte
+}
+
+// ProveMany returns a proof that all keys are in the tree under the root
+// returned by the last call to Root or Hash. keys must be sorted lexicographically
+// and unique. It returns false if any key is not present.
+func (t *Tree) ProveMany(keys [][]byte) (*MultiProof, bool) {
+	if len(keys) == 0 {
+		return nil, false
+	}
+	for i, key := range keys {
+		if i > 0 && bytes.Compare(keys[i-1], key) >= 0 || len(key) > t.maxKeyLen() {
+			return nil, false
+		}
+	}
+	paths, order := t.pathOrder(keys)
+	depths := make([]int, len(keys))
+	paddedKeys := make([][]byte, len(keys))
+	for i, path := range paths {
+		key := keys[order[i]]
+		paddedKey := make([]byte, MaxKeyLenPadded)
+		paddedKey, partialBits := PadKey(path, paddedKey)
+		pageIdx, pathLen, page := t.lookup(paddedKey, partialBits)
+		if pathLen == 0 {
+			return nil, false
+		}
+		node := &page.Nodes[indexOf(paddedKey[pageIdx], pathLen)]
+		if node.IsHash() {
+			return nil, false
+		}
+		var keyBuf [MaxHashedKeyLen]byte
+		if !bytes.Equal(node.AsLeafNode().GetKey(keyBuf[:], t.Datastore), key) {
+			return nil, false
+		}
+		paddedKeys[i] = paddedKey
+		depths[i] = fullBits*pageIdx + int(pathLen)
+	}
+
+	proof := &MultiProof{Depths: make([]int, len(keys))}
+	if !t.proveMany(paths, paddedKeys, depths, 0, &proof.Siblings) {
+		return nil, false
+	}
+	for i, depth := range depths {
+		proof.Depths[order[i]] = depth
+	}
+	return proof, true
+}
+
+// pathOrder returns the paths of keys, sorted, along with the index
+// in keys of each path. Unless keys are hashed, these are keys themselves.
+func (c *config) pathOrder(keys [][]byte) ([][]byte, []int) {
+	paths := make([][]byte, len(keys))
+	order := make([]int, len(keys))
+	for i, key := range keys {
+		paths[i] = c.path(key)
+		order[i] = i
+	}
+	if c.hashedKeys {
+		sort.Sort(byPath{paths, order})
+	}
+	return paths, order
+}
+
+// byPath sorts paths along with their indices.
+type byPath struct {
+	paths [][]byte
+	order []int
+}
+
+func (s byPath) Len() int           { return len(s.paths) }
+func (s byPath) Less(i, j int) bool { return bytes.Compare(s.paths[i], s.paths[j]) < 0 }
+func (s byPath) Swap(i, j int) {
+	s.paths[i], s.paths[j] = s.paths[j], s.paths[i]
+	s.order[i], s.order[j] = s.order[j], s.order[i]
+}
+
+// proveMany appends the siblings needed to compute the node at depth on the
+// path of keys[0], assuming keys are exactly the keys below that node.
+// keys are the paths of the keys being proven.
+func (t *Tree) proveMany(keys, paddedKeys [][]byte, depths []int, depth int, siblings *[][]byte) bool {
+	split := depths[0]
+	if len(keys) > 1 {
+		// The keys' paths are shared down to the node at split, where they fork.
+		split = commonPrefixBitLen(keys[0], keys[len(keys)-1])
+		mid := splitKeys(keys, split)
+		if mid == 0 || mid == len(keys) {
+			return false
+		}
+		if !t.proveMany(keys[:mid], paddedKeys[:mid], depths[:mid], split+1, siblings) ||
+			!t.proveMany(keys[mid:], paddedKeys[mid:], depths[mid:], split+1, siblings) {
+			return false
+		}
+	}
+
+	var hashBytesBuf [maxHashBytesLen]byte
+	for d := split; d > depth; d-- {
+		pos := t.hashBytes(hashBytesBuf[:], t.siblingAt(paddedKeys[0], d), t.Datastore)
+		*siblings = append(*siblings, bytes.Clone(hashBytesBuf[:pos]))
+	}
+	return true
+}
+
+// siblingAt returns the sibling of the node at depth (> 0) on the path of paddedKey.
+func (t *Tree) siblingAt(paddedKey []byte, depth int) *Node {
+	pageIdx := (depth - 1) / fullBits
+	page := t.page(paddedKey[:pageIdx])
+	return &page.Nodes[indexOf(paddedKey[pageIdx], byte(depth-fullBits*pageIdx))^1]
+}
+
+// splitKeys returns the index of the first of the sorted keys with a 1 bit at depth.
+func splitKeys(keys [][]byte, depth int) int {
+	return sort.Search(len(keys), func(i int) bool {
+		return keyBit(keys[i], depth) == 1
+	})
+}
+
+// VerifyMultiProof reports whether proof shows that each of keys is set to
+// the corresponding value in the tree with the given root.
+func VerifyMultiProof(root Node, keys, values [][]byte, proof *MultiProof, opts ...Option) bool {
+	if len(keys) == 0 || len(keys) != len(values) || len(keys) != len(proof.Depths) {
+		return false
+	}
+	c := newConfig(opts)
+	for i, key := range keys {
+		if i > 0 && bytes.Compare(keys[i-1], key) >= 0 {
+			return false
+		}
+		if len(key) == 0 || len(key) > c.maxKeyLen() || len(values[i]) > MaxValueLen {
+			return false
+		}
+		if d := proof.Depths[i]; d <= 0 || d > fullBits*MaxKeyLenPadded {
+			return false
+		}
+	}
+
+	paths, order := c.pathOrder(keys)
+	sortedKeys := make([][]byte, len(keys))
+	sortedValues := make([][]byte, len(keys))
+	depths := make([]int, len(keys))
+	for i, j := range order {
+		sortedKeys[i], sortedValues[i], depths[i] = keys[j], values[j], proof.Depths[j]
+	}
+	v := multiVerifier{config: &c, siblings: proof.Siblings}
+	node, ok := v.node(paths, sortedKeys, sortedValues, depths, 0)
+	return ok && len(v.siblings) == 0 && bytes.Equal(node, root[:])
+}
+
+type multiVerifier struct {
+	*config
+	siblings [][]byte // siblings not yet used
+}
+
+// node returns the hash bytes of the node at depth on paths[0],
+// assuming keys, found at paths, are exactly the keys below that node.
+func (v *multiVerifier) node(paths, keys, values [][]byte, depths []int, depth int) ([]byte, bool) {
+	var node []byte
+	split := depths[0]
+	if len(keys) == 1 {
+		if split < depth {
+			return nil, false
+		}
+		node = v.leafHashBytes(keys[0], values[0])
+	} else {
+		split = commonPrefixBitLen(paths[0], paths[len(paths)-1])
+		mid := splitKeys(paths, split)
+		if mid == 0 || mid == len(keys) {
+			return nil, false
+		}
+		left, ok := v.node(paths[:mid], keys[:mid], values[:mid], depths[:mid], split+1)
+		if !ok {
+			return nil, false
+		}
+		right, ok := v.node(paths[mid:], keys[mid:], values[mid:], depths[mid:], split+1)
+		if !ok {
+			return nil, false
+		}
+		parent := v.hashInternal(append(left, right...))
+		node = parent[:]
+	}
+
+	if len(v.siblings) < split-depth {
+		return nil, false
+	}
+	siblings := v.siblings[:split-depth]
+	v.siblings = v.siblings[split-depth:]
+	return v.hashUp(node, paths[0], split, siblings), true
+}
@@ -0,0 +1,62 @@
+package nomt
+
+import (
+	"bytes"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProveMany(t *testing.T) {
+	tr, values := randomTree(1_000)
+	var allKeys [][]byte
+	for key := range values {
+		allKeys = append(allKeys, []byte(key))
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for _, numKeys := range []int{1, 2, 10, 100, len(allKeys)} {
+		keys := make([][]byte, 0, numKeys)
+		for _, i := range r.Perm(len(allKeys))[:numKeys] {
+			keys = append(keys, allKeys[i])
+		}
+		slices.SortFunc(keys, bytes.Compare)
+		vals := make([][]byte, len(keys))
+		for i, key := range keys {
+			vals[i] = values[string(key)]
+		}
+
+		proof, ok := tr.ProveMany(keys)
+		require.True(t, ok)
+		require.True(t, VerifyMultiProof(tr.Root(), keys, vals, proof))
+
+		// Shared siblings are only included once.
+		numSiblings := 0
+		for _, key := range keys {
+			single, ok := tr.Prove(key)
+			require.True(t, ok)
+			numSiblings += len(single.Siblings)
+		}
+		require.LessOrEqual(t, len(proof.Siblings), numSiblings)
+		t.Logf("Keys: %d, siblings: %d (%d without sharing)", numKeys, len(proof.Siblings), numSiblings)
+
+		vals[len(vals)-1] = append(vals[len(vals)-1], 0)
+		require.False(t, VerifyMultiProof(tr.Root(), keys, vals, proof))
+		vals[len(vals)-1] = vals[len(vals)-1][:len(vals[len(vals)-1])-1]
+
+		require.False(t, VerifyMultiProof(Node{0x80}, keys, vals, proof))
+		proof.Siblings = append(proof.Siblings, []byte{0, 0})
+		require.False(t, VerifyMultiProof(tr.Root(), keys, vals, proof))
+	}
+
+	_, ok := tr.ProveMany([][]byte{[]byte("missing")})
+	require.False(t, ok)
+
+	// Keys must be sorted.
+	keys := [][]byte{allKeys[0], allKeys[1]}
+	slices.SortFunc(keys, func(a, b []byte) int { return bytes.Compare(b, a) })
+	_, ok = tr.ProveMany(keys)
+	require.False(t, ok)
+}
@@ -1,11 +1,15 @@
 package nomt
 
 import (
+	"encoding/binary"
 	"unsafe"
 )
 
 const (
 	LeafNodeMarker = 0x02
+	// OverflowLeafNodeMarker marks leaves whose value is longer than
+	// MaxInlineValueLen and is stored in overflow chunks.
+	OverflowLeafNodeMarker = 0x03
 )
 
 type (
@@ -17,10 +21,18 @@ func (c *ChunkIndex) AsInt() uint32 {
 	return uint32(c[0])<<24 | uint32(c[1])<<16 | uint32(c[2])<<8 | uint32(c[3])
 }
 
+func chunkIndex(idx uint32) ChunkIndex {
+	return ChunkIndex{byte(idx >> 24), byte(idx >> 16), byte(idx >> 8), byte(idx)}
+}
+
 func (n *Node) AsLeafNode() *LeafNode {
 	return (*LeafNode)(unsafe.Pointer(n))
 }
 
+// overflowLeafPrefix starts the hash bytes of overflow leaves. Other leaves
+// start with their key length, below it, and internal nodes with their top bit set.
+const overflowLeafPrefix = 0x7f
+
 func (n *Node) HashBytes(out []byte, d *Datastore) int {
 	pos := 0
 	if n.IsHash() {
@@ -29,6 +41,18 @@ func (n *Node) HashBytes(out []byte, d *Datastore) int {
 	}
 
 	leaf := n.AsLeafNode()
+	if leaf.isOverflow() {
+		// The value is replaced by its hash, and the leaf marked
+		// so that it cannot be mistaken for an inline value.
+		out[pos] = overflowLeafPrefix
+		pos++
+		out[pos] = leaf.KeyLen
+		pos++
+		pos += copy(out[pos:], leaf.GetKey(out[pos:], d))
+		valueHash := leaf.valueHash(d)
+		pos += copy(out[pos:], valueHash[:])
+		return pos
+	}
 	out[pos] = leaf.KeyLen
 	pos++
 	out[pos] = leaf.ValueLen
@@ -58,13 +82,28 @@ func (n *Node) MarkInternal() {
 }
 
 type LeafNode struct {
-	NodeMarker byte // must be 0x02.
+	NodeMarker byte // must be LeafNodeMarker or OverflowLeafNodeMarker.
 	KeyLen     byte
-	ValueLen   byte
+	ValueLen   byte // 0 for overflow leaves
 	Chunks     [7]ChunkIndex
 	_          [1]byte // ignored
 }
 
+// An overflow leaf keeps its key in the first chunks like any leaf, and the index
+// of a header chunk in its last chunk slot. The header chunk holds the hash of the
+// value, its length and the index of the first data chunk. Each data chunk holds
+// overflowChunkData bytes of the value followed by the index of the next one.
+const (
+	overflowHeaderSlot = len(LeafNode{}.Chunks) - 1
+	overflowLenPos     = len(Node{})
+	overflowFirstPos   = overflowLenPos + 4
+	overflowChunkData  = ChunkSize - len(ChunkIndex{})
+)
+
+func (l *LeafNode) isOverflow() bool {
+	return l.NodeMarker == OverflowLeafNodeMarker
+}
+
 func (l *LeafNode) get(buf []byte, startChunk, chunkPos int, length int, db *Datastore) {
 	pos, chunk := 0, startChunk
 	for pos < length {
@@ -73,7 +112,7 @@ func (l *LeafNode) get(buf []byte, startChunk, chunkPos int, length int, db *Dat
 			last = length
 		}
 		chunkID := l.Chunks[chunk].AsInt()
-		pos = pos + copy(buf[pos:last], db.Data[chunkID][chunkPos:])
+		pos = pos + copy(buf[pos:last], db.Chunk(chunkID)[chunkPos:])
 		chunk++
 		chunkPos = 0 // reading next chunk always starts at the beginning
 	}
@@ -87,7 +126,7 @@ func (l *LeafNode) put(buf []byte, startChunk, chunkPos int, length int, db *Dat
 			last = length
 		}
 		chunkID := l.Chunks[chunk].AsInt()
-		pos = pos + copy(db.Data[chunkID][chunkPos:], buf[pos:last])
+		pos = pos + copy(db.chunkForWrite(chunkID)[chunkPos:], buf[pos:last])
 		chunk++
 		chunkPos = 0 // writing next chunk always starts at the beginning
 	}
@@ -99,52 +138,170 @@ func (l *LeafNode) valueStart() (int, int) {
 	return int(chunk), chunkPos
 }
 
+// ValueLength returns the length of the leaf's value.
+func (l *LeafNode) ValueLength(db *Datastore) int {
+	if !l.isOverflow() {
+		return int(l.ValueLen)
+	}
+	header := db.Chunk(l.Chunks[overflowHeaderSlot].AsInt())
+	return int(binary.BigEndian.Uint32(header[overflowLenPos:]))
+}
+
+// valueHash returns the hash of an overflow leaf's value, computed when it was stored.
+func (l *LeafNode) valueHash(db *Datastore) [32]byte {
+	return [32]byte(db.Chunk(l.Chunks[overflowHeaderSlot].AsInt())[:overflowLenPos])
+}
+
 func (l *LeafNode) GetKey(buf []byte, db *Datastore) []byte {
 	l.get(buf, 0, 0, int(l.KeyLen), db)
 	return buf[:l.KeyLen]
 }
 
+// GetValue reads the leaf's value into buf, or into a new slice if buf is too small.
 func (l *LeafNode) GetValue(buf []byte, db *Datastore) []byte {
+	n := l.ValueLength(db)
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	if l.isOverflow() {
+		pos := 0
+		l.overflowChunks(db, func(_ uint32, data []byte) {
+			pos += copy(buf[pos:], data)
+		})
+		return buf
+	}
 	chunk, chunkPos := l.valueStart()
-	l.get(buf, chunk, chunkPos, int(l.ValueLen), db)
-	return buf[:l.ValueLen]
+	l.get(buf, chunk, chunkPos, n, db)
+	return buf
 }
 
-func (l *LeafNode) PutValue(value []byte, db *Datastore) {
-	l.allocExact(
-		numChunks(int(l.KeyLen), int(l.ValueLen)),
-		numChunks(int(l.KeyLen), len(value)),
-		db,
-	)
+// PutValue replaces the leaf's value. h hashes values stored in overflow chunks.
+// It returns ErrOutOfChunks, leaving the leaf unchanged, if db cannot hold the value.
+func (l *LeafNode) PutValue(value []byte, h Hasher, db *Datastore) error {
+	if err := l.reserve(int(l.KeyLen), len(value), db); err != nil {
+		return err
+	}
+	l.freeOverflow(db)
+	if len(value) > MaxInlineValueLen {
+		l.allocExact(l.inlineChunks(), numChunks(int(l.KeyLen), 0), db)
+		l.putOverflow(value, h, db)
+		return nil
+	}
+	l.allocExact(l.inlineChunks(), numChunks(int(l.KeyLen), len(value)), db)
 	l.ValueLen = byte(len(value))
 	chunk, chunkPos := l.valueStart()
 	l.put(value, chunk, chunkPos, len(value), db)
+	return nil
 }
 
-func (l *LeafNode) PutKeyValue(key, value []byte, db *Datastore) {
-	l.allocExact(
-		numChunks(int(l.KeyLen), int(l.ValueLen)),
-		numChunks(len(key), len(value)),
-		db,
-	)
+// PutKeyValue replaces the leaf's key and value. h hashes values stored in overflow chunks.
+// It returns ErrOutOfChunks, leaving the leaf unchanged, if db cannot hold the key and value.
+func (l *LeafNode) PutKeyValue(key, value []byte, h Hasher, db *Datastore) error {
+	if err := l.reserve(len(key), len(value), db); err != nil {
+		return err
+	}
+	l.freeOverflow(db)
+	inlineLen := len(value)
+	if inlineLen > MaxInlineValueLen {
+		inlineLen = 0
+	}
+	l.allocExact(l.inlineChunks(), numChunks(len(key), inlineLen), db)
 	l.NodeMarker = LeafNodeMarker
 	l.KeyLen = byte(len(key))
-	l.ValueLen = byte(len(value))
+	l.ValueLen = byte(inlineLen)
 
 	l.put(key, 0, 0, len(key), db)
+	if len(value) > MaxInlineValueLen {
+		l.putOverflow(value, h, db)
+		return nil
+	}
 	chunk, chunkPos := l.valueStart()
 	l.put(value, chunk, chunkPos, len(value), db)
+	return nil
+}
+
+// reserve returns ErrOutOfChunks if db does not have the chunks
+// needed to replace the leaf's key and value with ones of the given lengths.
+func (l *LeafNode) reserve(keyLen, valueLen int, db *Datastore) error {
+	if leafChunks(keyLen, valueLen)-leafChunks(int(l.KeyLen), l.ValueLength(db)) > db.Available() {
+		return ErrOutOfChunks
+	}
+	return nil
+}
+
+// putOverflow stores value in newly allocated overflow chunks.
+// The leaf must not already have an overflow value.
+func (l *LeafNode) putOverflow(value []byte, h Hasher, db *Datastore) {
+	headerIdx := db.alloc()
+	l.NodeMarker = OverflowLeafNodeMarker
+	l.ValueLen = 0
+	l.Chunks[overflowHeaderSlot] = chunkIndex(headerIdx)
+
+	header := db.chunkForWrite(headerIdx)
+	valueHash := hashWith(h, value)
+	copy(header[:overflowLenPos], valueHash[:])
+	binary.BigEndian.PutUint32(header[overflowLenPos:], uint32(len(value)))
+	link := header[overflowFirstPos:]
+	for pos := 0; pos < len(value); pos += overflowChunkData {
+		idx := db.alloc()
+		binary.BigEndian.PutUint32(link, idx)
+		chunk := db.chunkForWrite(idx)
+		copy(chunk[:overflowChunkData], value[pos:])
+		link = chunk[overflowChunkData:]
+	}
+}
+
+// overflowChunks calls fn for each chunk of an overflow value, starting with the
+// header chunk, passing the part of the value the chunk holds (nil for the header).
+func (l *LeafNode) overflowChunks(db *Datastore, fn func(idx uint32, data []byte)) {
+	headerIdx := l.Chunks[overflowHeaderSlot].AsInt()
+	header := db.Chunk(headerIdx)
+	n := int(binary.BigEndian.Uint32(header[overflowLenPos:]))
+	link := header[overflowFirstPos:]
+	fn(headerIdx, nil)
+	for pos := 0; pos < n; pos += overflowChunkData {
+		idx := binary.BigEndian.Uint32(link)
+		chunk := db.Chunk(idx)
+		link = chunk[overflowChunkData:]
+		fn(idx, chunk[:min(overflowChunkData, n-pos)])
+	}
+}
+
+// freeOverflow frees the leaf's overflow value, if it has one, leaving it with an empty inline value.
+func (l *LeafNode) freeOverflow(db *Datastore) {
+	if !l.isOverflow() {
+		return
+	}
+	l.overflowChunks(db, func(idx uint32, _ []byte) {
+		db.Free(idx)
+	})
+	l.NodeMarker = LeafNodeMarker
+	l.Chunks[overflowHeaderSlot] = ChunkIndex{}
 }
 
 func numChunks(keyLen, valueLen int) int {
 	return (keyLen + valueLen + ChunkSize - 1) / ChunkSize
 }
 
+// leafChunks returns the number of chunks used by a leaf
+// holding a key and value of the given lengths.
+func leafChunks(keyLen, valueLen int) int {
+	if valueLen > MaxInlineValueLen {
+		return numChunks(keyLen, 0) + 1 + (valueLen+overflowChunkData-1)/overflowChunkData
+	}
+	return numChunks(keyLen, valueLen)
+}
+
+// inlineChunks returns the number of chunks in l.Chunks holding the key and an inline value.
+func (l *LeafNode) inlineChunks() int {
+	return numChunks(int(l.KeyLen), int(l.ValueLen))
+}
+
 func (l *LeafNode) allocExact(current, want int, d *Datastore) {
 	if want > current {
 		for i := current; i < want; i++ {
-			newChunkIndex := d.Alloc()
-			l.Chunks[i] = ChunkIndex{byte(newChunkIndex >> 24), byte(newChunkIndex >> 16), byte(newChunkIndex >> 8), byte(newChunkIndex)}
+			l.Chunks[i] = chunkIndex(d.alloc())
 		}
 	} else if want < current {
 		for i := want; i < current; i++ {
@@ -154,6 +311,31 @@ func (l *LeafNode) allocExact(current, want int, d *Datastore) {
 	}
 }
 
+// chunks calls fn with the index of each chunk holding the leaf's key and value.
+func (l *LeafNode) chunks(d *Datastore, fn func(idx uint32)) {
+	for _, chunk := range l.Chunks[:l.inlineChunks()] {
+		fn(chunk.AsInt())
+	}
+	if l.isOverflow() {
+		l.overflowChunks(d, func(idx uint32, _ []byte) {
+			fn(idx)
+		})
+	}
+}
+
+// shared reports whether any of the leaf's chunks is referenced by more than the leaf.
+func (l *LeafNode) shared(d *Datastore) bool {
+	if d.readOnly == 0 && len(d.refs) == 0 {
+		return false
+	}
+	shared := false
+	l.chunks(d, func(idx uint32) {
+		shared = shared || d.shared(idx)
+	})
+	return shared
+}
+
 func (l *LeafNode) Free(d *Datastore) {
-	l.allocExact(numChunks(int(l.KeyLen), int(l.ValueLen)), 0, d)
+	l.freeOverflow(d)
+	l.allocExact(l.inlineChunks(), 0, d)
 }
@@ -2,6 +2,7 @@ package nomt
 
 import (
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/require"
 )
@@ -17,7 +18,7 @@ func TestLeafNodeChunks(t *testing.T) {
 
 	k := []byte("hello")
 	v := []byte("world")
-	leafNode.PutKeyValue(k, v, d)
+	leafNode.PutKeyValue(k, v, SHA3Hasher{}, d)
 
 	var keyBuf [MaxKeyLen]byte
 	key := keyBuf[:]
@@ -30,7 +31,48 @@ func TestLeafNodeChunks(t *testing.T) {
 	require.Equal(t, v, val)
 
 	v2 := []byte("world2")
-	leafNode.PutKeyValue(k, v2, d)
+	leafNode.PutKeyValue(k, v2, SHA3Hasher{}, d)
 	val = leafNode.GetValue(val, d)
 	require.Equal(t, v2, val)
 }
+
+func TestLeafNodeOverflow(t *testing.T) {
+	d := New()
+	leafNode := LeafNode{}
+
+	k := []byte("hello")
+	large := make([]byte, 10_000)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	leafNode.PutKeyValue(k, large, SHA3Hasher{}, d)
+	require.True(t, leafNode.isOverflow())
+	require.Equal(t, len(large), leafNode.ValueLength(d))
+	require.Equal(t, SHA3Hasher{}.Hash(large), leafNode.valueHash(d))
+
+	var keyBuf [MaxKeyLen]byte
+	require.Equal(t, k, leafNode.GetKey(keyBuf[:], d))
+	require.Equal(t, large, leafNode.GetValue(nil, d))
+
+	// Going back to an inline value frees the overflow chunks.
+	leafNode.PutValue([]byte("world"), SHA3Hasher{}, d)
+	require.False(t, leafNode.isOverflow())
+	require.Equal(t, []byte("world"), leafNode.GetValue(nil, d))
+	require.Equal(t, 1, d.InUse())
+
+	leafNode.PutValue(large[:MaxInlineValueLen+1], SHA3Hasher{}, d)
+	require.Equal(t, large[:MaxInlineValueLen+1], leafNode.GetValue(nil, d))
+
+	// Its hash bytes are told apart from those of inline leaves and internal nodes.
+	var hashBytes [maxHashBytesLen]byte
+	n := (*Node)(unsafe.Pointer(&leafNode)).HashBytes(hashBytes[:], d)
+	require.Equal(t, byte(overflowLeafPrefix), hashBytes[0])
+	require.Equal(t, (&config{hasher: SHA3Hasher{}}).leafHashBytes(k, large[:MaxInlineValueLen+1]), hashBytes[:n])
+
+	var used int
+	leafNode.chunks(d, func(uint32) { used++ })
+	require.Equal(t, d.InUse(), used)
+
+	leafNode.Free(d)
+	require.Zero(t, d.InUse())
+}
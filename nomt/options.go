@@ -0,0 +1,101 @@
+package nomt
+
+// Option configures a Tree, or how a proof is verified.
+// Proofs must be verified with the options the tree was created with.
+type Option func(*config)
+
+type config struct {
+	hasher          Hasher
+	domainSeparated bool
+	hashedKeys      bool
+	historyLen      int
+	concurrentReads bool
+	pageBuckets     int
+}
+
+// fingerprint returns the bytes standing for the options a tree's nodes depend on:
+// the Hasher's digest of a fixed input, which tells hashers apart without naming
+// them, followed by a byte of flags.
+func (c *config) fingerprint() []byte {
+	digest := c.hash([]byte("nomt"))
+	var flags byte
+	if c.domainSeparated {
+		flags |= 1
+	}
+	if c.hashedKeys {
+		flags |= 2
+	}
+	return append(digest[:], flags)
+}
+
+func newConfig(opts []Option) config {
+	c := config{hasher: SHA3Hasher{}, pageBuckets: defaultPageBuckets}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// WithHasher sets the hash function internal nodes are computed with.
+// A tree opened with OpenTree must always be opened with the same Hasher,
+// which OpenTree checks.
+func WithHasher(h Hasher) Option {
+	return func(c *config) {
+		c.hasher = h
+	}
+}
+
+// WithDomainSeparation hashes leaves separately from internal nodes, tagging
+// each preimage with its kind: a leaf hashes to H(0x00||key||H(value)) and an
+// internal node to H(0x01||left||right), with the most significant bit of its
+// first byte then set to mark it as internal, as in trees without domain separation.
+// The root is such a node, and so are internal children in left and right,
+// while a leaf child is its hash and an empty child is 32 zero bytes.
+// This keeps leaves and internal nodes from being passed off as one another in proofs.
+func WithDomainSeparation() Option {
+	return func(c *config) {
+		c.domainSeparated = true
+	}
+}
+
+// WithHashedKeys places each key in the tree at the path given by its hash,
+// while the leaf still holds the key itself. Keys may then be up to
+// MaxHashedKeyLen bytes long and prefixes of one another.
+// Keys passed to Hash and ProveMany must still be sorted lexicographically.
+func WithHashedKeys() Option {
+	return func(c *config) {
+		c.hashedKeys = true
+	}
+}
+
+// WithHistory keeps the last versions committed to a tree, so that they can
+// be read with GetAt and ProveAt. Older versions are pruned as new ones are
+// committed. History is kept in memory only, and starts over when a tree is
+// reopened. It has no effect on how proofs are verified.
+func WithHistory(versions int) Option {
+	return func(c *config) {
+		c.historyLen = versions
+	}
+}
+
+// WithConcurrentReads publishes each version committed to a tree, so that
+// any number of goroutines can read it with View while the next one is
+// applied. The tree then copies each page before changing it for the first
+// time after a commit.
+func WithConcurrentReads() Option {
+	return func(c *config) {
+		c.concurrentReads = true
+	}
+}
+
+// defaultPageBuckets lets a tree opened with OpenTree hold 3.6GB of pages.
+const defaultPageBuckets = 1 << 20
+
+// WithPageBuckets sets the number of buckets of the BucketPageStore of a tree
+// created by OpenTree, which can hold pages in 90% of them. It has no effect
+// on trees whose pages are already stored, or on how proofs are verified.
+func WithPageBuckets(n int) Option {
+	return func(c *config) {
+		c.pageBuckets = n
+	}
+}
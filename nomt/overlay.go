@@ -0,0 +1,215 @@
+package nomt
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// Overlay buffers changes on top of a Tree, or of another Overlay, without
+// changing the pages or chunks below it. Reads see the overlay's own changes
+// first. The changes can then be merged into what the overlay is layered on,
+// or dropped.
+//
+// An overlay must not be used after what it is layered on changes.
+type Overlay struct {
+	tree    *Tree
+	parent  *Overlay // nil for overlays layered on the tree
+	changes map[string]batchOp
+}
+
+// Overlay returns an empty overlay layered on the tree.
+func (t *Tree) Overlay() *Overlay {
+	return &Overlay{tree: t, changes: make(map[string]batchOp)}
+}
+
+// Overlay returns an empty overlay layered on o.
+func (o *Overlay) Overlay() *Overlay {
+	return &Overlay{tree: o.tree, parent: o, changes: make(map[string]batchOp)}
+}
+
+// Get returns the value of key as changed by the overlay and those below it,
+// read into valBuf or into a new slice if valBuf is too small.
+func (o *Overlay) Get(key []byte, valBuf []byte) ([]byte, bool) {
+	for p := o; p != nil; p = p.parent {
+		if op, ok := p.changes[string(key)]; ok {
+			if op.delete {
+				return nil, false
+			}
+			return append(valBuf[:0], op.value...), true
+		}
+	}
+	return o.tree.Get(key, valBuf)
+}
+
+// Put sets key to value in the overlay. It returns ErrEmptyKey, ErrKeyTooLong or
+// ErrValueTooLong for keys and values the tree cannot hold. Other errors,
+// such as ErrKeyPrefixConflict, are only returned once the changes are
+// applied to the tree, by Root or Merge.
+func (o *Overlay) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > o.tree.maxKeyLen() {
+		return ErrKeyTooLong
+	}
+	if len(value) > MaxValueLen {
+		return ErrValueTooLong
+	}
+	o.changes[string(key)] = batchOp{key: bytes.Clone(key), value: bytes.Clone(value)}
+	return nil
+}
+
+// Delete deletes key in the overlay and reports whether it was present.
+func (o *Overlay) Delete(key []byte) bool {
+	_, ok := o.Get(key, nil)
+	if ok {
+		o.changes[string(key)] = batchOp{key: bytes.Clone(key), delete: true}
+	}
+	return ok
+}
+
+// Root returns the root the tree would have with the changes of the overlay
+// and those below it, or the error the first change that cannot be applied
+// to the tree would cause.
+//
+// The changes are applied to a shadow of the tree, which copies the pages
+// it changes and stores new leaves in chunks of its own, and hashed as Root does.
+func (o *Overlay) Root() (Node, error) {
+	shadow := o.tree.shadow()
+	if err := o.applyAll(shadow); err != nil {
+		return o.tree.root, err
+	}
+	return shadow.Root(), nil
+}
+
+// applyAll applies the changes of the overlay and those below it to t.
+func (o *Overlay) applyAll(t *Tree) error {
+	changes := make(map[string]batchOp)
+	for p := o; p != nil; p = p.parent {
+		for key, op := range p.changes {
+			if _, ok := changes[key]; !ok {
+				changes[key] = op
+			}
+		}
+	}
+	return applyChanges(t, changes)
+}
+
+// applyChanges applies changes to t in key order. If one cannot be applied,
+// those before it are undone.
+func applyChanges(t *Tree, changes map[string]batchOp) error {
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	ops := make([]batchOp, len(keys))
+	for i, key := range keys {
+		ops[i] = changes[key]
+	}
+	return t.applyOps(ops)
+}
+
+// Merge moves the overlay's changes into what it is layered on, leaving it empty.
+// Changes are applied to a tree with Put and Delete, in key order, and are not
+// hashed or committed. If one of them cannot be applied, Merge returns its error,
+// leaving both the tree and the overlay as they were.
+func (o *Overlay) Merge() error {
+	if o.parent != nil {
+		maps.Copy(o.parent.changes, o.changes)
+	} else if err := applyChanges(o.tree, o.changes); err != nil {
+		return err
+	}
+	clear(o.changes)
+	return nil
+}
+
+// Drop discards the overlay's changes, leaving it empty.
+func (o *Overlay) Drop() {
+	clear(o.changes)
+}
+
+// shadow returns a tree that reads t's pages and chunks, but never changes them.
+func (t *Tree) shadow() *Tree {
+	return &Tree{
+		Pages:          &shadowPages{base: t.Pages, pages: make(map[string]*Page)},
+		Datastore:      t.Datastore.shadow(),
+		HashSplitDepth: t.HashSplitDepth,
+		config:         t.config,
+		root:           t.root,
+		dirty:          maps.Clone(t.dirty),
+	}
+}
+
+// shadowPages is the PageStore of a shadow tree. Pages are copied from
+// the tree it shadows the first time they are read, so that they can be changed.
+type shadowPages struct {
+	mu    sync.Mutex // guards pages while the shadow tree is hashed in parallel
+	base  PageStore
+	pages map[string]*Page // copied and added pages, nil for deleted ones
+}
+
+func (s *shadowPages) Page(path []byte) *Page {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if page, ok := s.pages[string(path)]; ok {
+		return page
+	}
+	page := s.base.Page(path)
+	if page != nil {
+		copied := *page
+		page = &copied
+	}
+	s.pages[string(path)] = page
+	return page
+}
+
+func (s *shadowPages) Put(path []byte, page *Page) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pages[string(path)] = page
+}
+
+func (s *shadowPages) Delete(path []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pages[string(path)] = nil
+}
+
+func (s *shadowPages) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.base.Len()
+	for path, page := range s.pages {
+		switch base := s.base.Page([]byte(path)); {
+		case base == nil && page != nil:
+			n++
+		case base != nil && page == nil:
+			n--
+		}
+	}
+	return n
+}
+
+func (s *shadowPages) Range(fn func(path []byte, page *Page) bool) error {
+	s.mu.Lock()
+	pages := maps.Clone(s.pages)
+	s.mu.Unlock()
+	for path, page := range pages {
+		if page != nil && !fn([]byte(path), page) {
+			return nil
+		}
+	}
+	return s.base.Range(func(path []byte, page *Page) bool {
+		if _, ok := pages[string(path)]; ok {
+			return true
+		}
+		return fn(path, page)
+	})
+}
+
+func (s *shadowPages) Flush() error {
+	return nil
+}
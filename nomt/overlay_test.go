@@ -0,0 +1,117 @@
+package nomt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+)
+
+func TestOverlay(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	tr := NewTree()
+	_, err := tr.Commit(testBatch(0, 1_000))
+	require.NoError(t, err)
+	root, numChunks, inUse, numPages := tr.Root(), tr.Datastore.NumChunks, tr.Datastore.InUse(), tr.Pages.Len()
+
+	// expected is kept in sync with the changes made to the overlays.
+	expected := NewTree()
+	_, err = expected.Commit(testBatch(0, 1_000))
+	require.NoError(t, err)
+	change := func(o *Overlay, n int) {
+		for i := 0; i < n; i++ {
+			key := sha3.Sum256([]byte(fmt.Sprintf("key-%d", r.Intn(1_500))))
+			if r.Intn(3) == 0 {
+				require.Equal(t, expected.Delete(key[:]), o.Delete(key[:]))
+				continue
+			}
+			value := snapshotTestValue(r.Intn(1_000), i)
+			require.NoError(t, o.Put(key[:], value))
+			require.NoError(t, expected.Put(key[:], value))
+			val, ok := o.Get(key[:], nil)
+			require.True(t, ok)
+			require.Equal(t, value, val)
+		}
+	}
+	requireOverlay := func(o *Overlay) {
+		overlayRoot, err := o.Root()
+		require.NoError(t, err)
+		require.Equal(t, expected.Root(), overlayRoot)
+		var valBuf [MaxInlineValueLen]byte
+		for i := 0; i < 1_500; i++ {
+			key := sha3.Sum256([]byte(fmt.Sprintf("key-%d", i)))
+			val, ok := o.Get(key[:], valBuf[:])
+			expectedVal, expectedOk := expected.Get(key[:], nil)
+			require.Equal(t, expectedOk, ok)
+			require.Equal(t, expectedVal, bytes.Clone(val))
+		}
+	}
+
+	o := tr.Overlay()
+	change(o, 300)
+	requireOverlay(o)
+
+	// Nested overlays see the changes below them, and merge into them.
+	nested := o.Overlay()
+	change(nested, 300)
+	requireOverlay(nested)
+	require.NoError(t, nested.Merge())
+	requireOverlay(o)
+
+	// Until merged, the tree is unchanged.
+	require.Equal(t, root, tr.Root())
+	require.Equal(t, numChunks, tr.Datastore.NumChunks)
+	require.Equal(t, inUse, tr.Datastore.InUse())
+	require.Equal(t, numPages, tr.Pages.Len())
+	requireBatch(t, tr, testBatch(0, 1_000), true)
+
+	// Dropped changes are gone.
+	dropped := o.Overlay()
+	require.NoError(t, dropped.Put([]byte("dropped"), []byte("value")))
+	dropped.Drop()
+	_, ok := dropped.Get([]byte("dropped"), nil)
+	require.False(t, ok)
+
+	require.NoError(t, o.Merge())
+	require.Equal(t, expected.Root(), tr.Root())
+}
+
+func TestOverlayPrefixConflict(t *testing.T) {
+	tr := NewTree()
+	require.NoError(t, tr.Put([]byte("abc\x00"), []byte("value")))
+	root := tr.Root()
+
+	o := tr.Overlay()
+	require.NoError(t, o.Put([]byte("abc"), []byte("value")))
+	_, err := o.Root()
+	require.ErrorIs(t, err, ErrKeyPrefixConflict)
+	require.ErrorIs(t, o.Merge(), ErrKeyPrefixConflict)
+	require.Equal(t, root, tr.Root())
+	require.ErrorIs(t, o.Put(make([]byte, MaxKeyLen+1), nil), ErrKeyTooLong)
+
+	// Changes ordered before the conflicting one are not merged either,
+	// and the overlay keeps them all.
+	require.NoError(t, o.Put([]byte("aaa"), []byte("value")))
+	require.True(t, o.Delete([]byte("abc\x00")))
+	require.ErrorIs(t, o.Merge(), ErrKeyPrefixConflict)
+	require.Equal(t, root, tr.Root())
+	_, ok := tr.Get([]byte("aaa"), nil)
+	require.False(t, ok)
+	_, ok = tr.Get([]byte("abc\x00"), nil)
+	require.True(t, ok)
+	val, ok := o.Get([]byte("aaa"), nil)
+	require.True(t, ok)
+	require.Equal(t, []byte("value"), val)
+
+	// Once the conflict is resolved, the overlay merges.
+	o.Delete([]byte("abc"))
+	require.NoError(t, o.Merge())
+	_, ok = tr.Get([]byte("abc\x00"), nil)
+	require.False(t, ok)
+	_, ok = tr.Get([]byte("aaa"), nil)
+	require.True(t, ok)
+	require.Empty(t, o.changes)
+}
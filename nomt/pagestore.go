@@ -0,0 +1,559 @@
+package nomt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const PageSize = int(unsafe.Sizeof(Page{}))
+
+// PageStore holds the pages of a Tree, keyed by the padded key prefix leading to them.
+// Page and Put may be called concurrently while the tree is hashed in parallel,
+// but never for the same page.
+type PageStore interface {
+	// Page returns the page at path, or nil if there is none.
+	Page(path []byte) *Page
+	// Put stores page at path. It must also be called for a page
+	// returned by Page before that page is modified.
+	Put(path []byte, page *Page)
+	// Delete removes the page at path.
+	Delete(path []byte)
+	// Len returns the number of pages.
+	Len() int
+	// Range calls fn for each page until fn returns false.
+	// fn may call Page, but must not add or delete pages.
+	Range(fn func(path []byte, page *Page) bool) error
+	// Flush persists the pages modified since the last call to Flush.
+	Flush() error
+}
+
+// errReporter is implemented by page stores that can fail to read pages.
+type errReporter interface {
+	// Err returns the first error reading a page.
+	Err() error
+}
+
+// pageStoreErr returns the error pages failed with, if any.
+func pageStoreErr(pages PageStore) error {
+	if r, ok := pages.(errReporter); ok {
+		return r.Err()
+	}
+	return nil
+}
+
+// changeLister is implemented by page stores that can list the pages
+// modified since their last Flush, so that they can be logged first.
+type changeLister interface {
+	// Changes calls fn for each page modified since the last Flush,
+	// passing a nil page for deleted pages.
+	Changes(fn func(path []byte, page *Page))
+}
+
+// closePageStore closes pages if it holds open files.
+func closePageStore(pages PageStore) error {
+	if c, ok := pages.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (p *Page) bytes() []byte {
+	return (*[PageSize]byte)(unsafe.Pointer(p))[:]
+}
+
+// pageAllocator is implemented by page stores that allocate the pages they hold.
+type pageAllocator interface {
+	// newPage returns an empty page.
+	newPage() *Page
+	// freePage takes back page, which is no longer referenced.
+	freePage(page *Page)
+}
+
+// newPage returns an empty page, from the page store if it allocates pages.
+func (t *Tree) newPage() *Page {
+	if a, ok := t.Pages.(pageAllocator); ok {
+		return a.newPage()
+	}
+	return &Page{}
+}
+
+// freePage hands page back to the page store if it allocates pages.
+// Neither the tree nor any snapshot may reference page.
+func (t *Tree) freePage(page *Page) {
+	if a, ok := t.Pages.(pageAllocator); ok {
+		a.freePage(page)
+	}
+}
+
+// idPageStore is implemented by page stores that look pages up by page ID.
+// Unlike a path, an ID is passed by value, so the padded key a path is
+// sliced from is not made to escape to the heap by calls through the interface.
+type idPageStore interface {
+	pageByID(id pageID) *Page
+	putByID(id pageID, page *Page)
+	deleteByID(id pageID)
+}
+
+// page returns the page at path. It does not allocate for page stores
+// implementing idPageStore, while others are given a copy of path.
+func (t *Tree) page(path []byte) *Page {
+	if s, ok := t.Pages.(idPageStore); ok {
+		return s.pageByID(newPageID(path))
+	}
+	return t.Pages.Page(bytes.Clone(path))
+}
+
+// storePage stores page at path. Like page, it does not allocate
+// for page stores implementing idPageStore.
+func (t *Tree) storePage(path []byte, page *Page) {
+	if s, ok := t.Pages.(idPageStore); ok {
+		s.putByID(newPageID(path), page)
+		return
+	}
+	t.Pages.Put(bytes.Clone(path), page)
+}
+
+// removePage removes the page at path. Like page, it does not allocate
+// for page stores implementing idPageStore.
+func (t *Tree) removePage(path []byte) {
+	if s, ok := t.Pages.(idPageStore); ok {
+		s.deleteByID(newPageID(path))
+		return
+	}
+	t.Pages.Delete(bytes.Clone(path))
+}
+
+// memPageStore keeps all pages in memory. Pages are allocated in blocks and
+// indexed by an open-addressing hash table, keyed by hashes of page IDs.
+//
+// Replacing the page at a path only swaps the page in that path's slot,
+// so lookups may run concurrently, as when the tree is hashed in parallel.
+type memPageStore struct {
+	seed  maphash.Seed
+	slots []pageSlot // linear probing, with a power-of-two length
+	count int
+
+	blocks []*[pageBlockLen]Page
+	used   int     // pages handed out from the last block
+	free   []*Page // pages to hand out again
+}
+
+type pageSlot struct {
+	hash uint64
+	page atomic.Pointer[Page] // nil for an empty slot
+}
+
+// move moves the page in from to s, leaving from empty.
+func (s *pageSlot) move(from *pageSlot) {
+	s.hash = from.hash
+	s.page.Store(from.page.Swap(nil))
+}
+
+const (
+	pageBlockLen   = 64 // 256KB per block
+	minPageSlots   = 64
+	maxLoadPercent = 75
+)
+
+func newMemPageStore() *memPageStore {
+	s := &memPageStore{
+		seed:  maphash.MakeSeed(),
+		slots: make([]pageSlot, minPageSlots),
+	}
+	s.Put(nil, s.newPage())
+	return s
+}
+
+func (s *memPageStore) newPage() *Page {
+	if n := len(s.free); n > 0 {
+		page := s.free[n-1]
+		s.free = s.free[:n-1]
+		*page = Page{}
+		return page
+	}
+	if len(s.blocks) == 0 || s.used == pageBlockLen {
+		s.blocks = append(s.blocks, new([pageBlockLen]Page))
+		s.used = 0
+	}
+	s.used++
+	return &s.blocks[len(s.blocks)-1][s.used-1]
+}
+
+func (s *memPageStore) freePage(page *Page) {
+	s.free = append(s.free, page)
+}
+
+// find returns the index of the slot holding the page with the given ID,
+// or of the empty slot where it would go, and the hash of the ID.
+func (s *memPageStore) find(id *pageID) (int, uint64) {
+	hash := maphash.Bytes(s.seed, id[:])
+	mask := len(s.slots) - 1
+	for i := int(hash) & mask; ; i = (i + 1) & mask {
+		slot := &s.slots[i]
+		page := slot.page.Load()
+		if page == nil || slot.hash == hash && page.id == *id {
+			return i, hash
+		}
+	}
+}
+
+func (s *memPageStore) Page(path []byte) *Page {
+	return s.pageByID(newPageID(path))
+}
+
+func (s *memPageStore) pageByID(id pageID) *Page {
+	i, _ := s.find(&id)
+	return s.slots[i].page.Load()
+}
+
+func (s *memPageStore) Put(path []byte, page *Page) {
+	s.putByID(newPageID(path), page)
+}
+
+func (s *memPageStore) putByID(id pageID, page *Page) {
+	i, hash := s.find(&id)
+	slot := &s.slots[i]
+	old := slot.page.Load()
+	if old == page {
+		return
+	}
+	page.id = id
+	if old == nil {
+		slot.hash = hash
+		s.count++
+	}
+	slot.page.Store(page)
+	if old == nil && 100*s.count > maxLoadPercent*len(s.slots) {
+		s.grow()
+	}
+}
+
+// grow doubles the number of slots.
+func (s *memPageStore) grow() {
+	slots := s.slots
+	s.slots = make([]pageSlot, 2*len(slots))
+	mask := len(s.slots) - 1
+	for j := range slots {
+		if slots[j].page.Load() == nil {
+			continue
+		}
+		i := int(slots[j].hash) & mask
+		for s.slots[i].page.Load() != nil {
+			i = (i + 1) & mask
+		}
+		s.slots[i].move(&slots[j])
+	}
+}
+
+func (s *memPageStore) Delete(path []byte) {
+	s.deleteByID(newPageID(path))
+}
+
+func (s *memPageStore) deleteByID(id pageID) {
+	i, _ := s.find(&id)
+	if s.slots[i].page.Load() == nil {
+		return
+	}
+	s.count--
+	s.slots[i].page.Store(nil)
+	// Shift back the slots after i that could not be found past the empty slot.
+	mask := len(s.slots) - 1
+	for j := (i + 1) & mask; s.slots[j].page.Load() != nil; j = (j + 1) & mask {
+		if home := int(s.slots[j].hash) & mask; (j-home)&mask >= (j-i)&mask {
+			s.slots[i].move(&s.slots[j])
+			i = j
+		}
+	}
+}
+
+func (s *memPageStore) Len() int {
+	return s.count
+}
+
+func (s *memPageStore) Range(fn func(path []byte, page *Page) bool) error {
+	for i := range s.slots {
+		page := s.slots[i].page.Load()
+		if page != nil && !fn(page.id.path(), page) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memPageStore) Flush() error {
+	return nil
+}
+
+// pageID identifies a page by its path, read as a number in bijective base 64:
+// the root page's ID is 0, and the page below the nodes at the bottom of
+// a page, at index i among them, has ID parent*64 + i + 1. IDs are big-endian.
+// Paths of up to MaxKeyLenPadded-1 bytes take at most 511 bits.
+type pageID [64]byte
+
+func newPageID(path []byte) pageID {
+	var id pageID
+	for n, child := range path {
+		carry := uint16(child) + 1
+		// With n+1 children, the ID takes at most fullBits*(n+1)+1 bits.
+		for i := len(id) - 1; i >= max(0, len(id)-(fullBits*(n+1)+8)/8); i-- {
+			v := uint16(id[i])<<fullBits + carry
+			id[i] = byte(v)
+			carry = v >> 8
+		}
+	}
+	return id
+}
+
+// path returns the path of the page with this ID.
+func (id pageID) path() []byte {
+	var path []byte
+	for id != (pageID{}) {
+		// Subtract 1, then take the last 6 bits off.
+		for i := len(id) - 1; i >= 0; i-- {
+			id[i]--
+			if id[i] != 0xff {
+				break
+			}
+		}
+		path = append(path, id[len(id)-1]&(1<<fullBits-1))
+		for i := len(id) - 1; i >= 0; i-- {
+			id[i] >>= fullBits
+			if i > 0 {
+				id[i] |= id[i-1] << (8 - fullBits)
+			}
+		}
+	}
+	slices.Reverse(path)
+	return path
+}
+
+// DirPageStore is a PageStore that keeps each page in its own file in a directory.
+// Pages are loaded on demand and held in memory until the next Flush.
+type DirPageStore struct {
+	mu      sync.Mutex // guards the maps, count and err
+	dir     string
+	pages   map[string]*Page // loaded pages
+	dirty   map[string]struct{}
+	deleted map[string]struct{}
+	count   int
+	err     error // the first error reading a page
+}
+
+// OpenDirPageStore opens the page store in dir, creating it if needed.
+func OpenDirPageStore(dir string) (*DirPageStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &DirPageStore{
+		dir:     dir,
+		pages:   make(map[string]*Page),
+		dirty:   make(map[string]struct{}),
+		deleted: make(map[string]struct{}),
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), pageFilePrefix) {
+			s.count++
+		}
+	}
+	return s, nil
+}
+
+// pageFilePrefix keeps the root page's file name from being empty.
+const pageFilePrefix = "p"
+
+func (s *DirPageStore) fileName(path string) string {
+	return filepath.Join(s.dir, pageFilePrefix+hex.EncodeToString([]byte(path)))
+}
+
+func (s *DirPageStore) Page(path []byte) *Page {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if page, ok := s.pages[string(path)]; ok {
+		return page
+	}
+	if _, ok := s.deleted[string(path)]; ok {
+		return nil
+	}
+	page, err := s.read(string(path))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil
+	case err != nil:
+		// An unreadable page is replaced by an empty one, so that the tree
+		// can be read on, and the store is failed.
+		s.fail(fmt.Errorf("reading page %x: %w", path, err))
+		page = &Page{}
+	}
+	s.pages[string(path)] = page
+	return page
+}
+
+// fail records err as the store's error, unless it already has one.
+func (s *DirPageStore) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Err returns the first error reading a page. Once there is one,
+// pages read since may be wrong, and Flush returns it without writing anything.
+func (s *DirPageStore) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *DirPageStore) read(path string) (*Page, error) {
+	f, err := os.Open(s.fileName(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	page := &Page{}
+	if _, err := f.ReadAt(page.bytes(), 0); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// exists reports whether there is a page at path, without loading it.
+func (s *DirPageStore) exists(path []byte) bool {
+	if _, ok := s.pages[string(path)]; ok {
+		return true
+	}
+	if _, ok := s.deleted[string(path)]; ok {
+		return false
+	}
+	_, err := os.Stat(s.fileName(string(path)))
+	return err == nil
+}
+
+func (s *DirPageStore) Put(path []byte, page *Page) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.exists(path) {
+		s.count++
+	}
+	s.pages[string(path)] = page
+	s.dirty[string(path)] = struct{}{}
+	delete(s.deleted, string(path))
+}
+
+func (s *DirPageStore) Delete(path []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exists(path) {
+		s.count--
+	}
+	delete(s.pages, string(path))
+	delete(s.dirty, string(path))
+	s.deleted[string(path)] = struct{}{}
+}
+
+// Changes calls fn for each page modified since the last Flush,
+// passing a nil page for deleted pages.
+func (s *DirPageStore) Changes(fn func(path []byte, page *Page)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for path := range s.dirty {
+		fn([]byte(path), s.pages[path])
+	}
+	for path := range s.deleted {
+		fn([]byte(path), nil)
+	}
+}
+
+func (s *DirPageStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Range calls fn for each page. Pages not already in memory are read
+// from disk without being retained. fn is called without the store locked.
+func (s *DirPageStore) Range(fn func(path []byte, page *Page) bool) error {
+	s.mu.Lock()
+	loaded := maps.Clone(s.pages)
+	deleted := maps.Clone(s.deleted)
+	s.mu.Unlock()
+	for path, page := range loaded {
+		if !fn([]byte(path), page) {
+			return nil
+		}
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), pageFilePrefix)
+		if !ok {
+			continue
+		}
+		path, err := hex.DecodeString(name)
+		if err != nil {
+			return err
+		}
+		if _, ok := loaded[string(path)]; ok {
+			continue
+		}
+		if _, ok := deleted[string(path)]; ok {
+			continue
+		}
+		page, err := s.read(string(path))
+		if err != nil {
+			return err
+		}
+		if !fn(path, page) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Flush writes modified pages to disk, removes deleted ones
+// and drops all pages from memory.
+func (s *DirPageStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	for path := range s.dirty {
+		if err := writeFileSync(s.fileName(path), s.pages[path].bytes()); err != nil {
+			return err
+		}
+	}
+	for path := range s.deleted {
+		if err := os.Remove(s.fileName(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	// Pages created or removed must stay so, along with their files' contents.
+	if len(s.dirty) > 0 || len(s.deleted) > 0 {
+		if err := syncDir(s.dir); err != nil {
+			return err
+		}
+	}
+	clear(s.pages)
+	clear(s.dirty)
+	clear(s.deleted)
+	return nil
+}
@@ -0,0 +1,275 @@
+package nomt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+)
+
+func TestOpenTree(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := OpenTree(dir)
+	require.NoError(t, err)
+	expected := NewTree()
+
+	batch := func(from, to int) {
+		var keys [][]byte
+		for i := from; i < to; i++ {
+			key := sha3.Sum256([]byte(fmt.Sprintf("key-%d", i)))
+			value := []byte(fmt.Sprintf("value-%d", i))
+			if i%5 == 0 && i > 0 {
+				// Delete a key added by an earlier batch.
+				key = sha3.Sum256([]byte(fmt.Sprintf("key-%d", i-3)))
+				require.True(t, tr.Delete(key[:]))
+				require.True(t, expected.Delete(key[:]))
+			} else {
+				tr.Put(key[:], value)
+				expected.Put(key[:], value)
+			}
+			keys = append(keys, key[:])
+		}
+		slices.SortFunc(keys, bytes.Compare)
+		require.Equal(t, mustHash(t, expected, keys), mustHash(t, tr, keys))
+		require.Equal(t, expected.Pages.Len(), tr.Pages.Len())
+	}
+
+	batch(0, 1_000)
+	require.NoError(t, tr.Flush())
+	batch(1_000, 2_000)
+	require.NoError(t, tr.Close())
+
+	reopened, err := OpenTree(dir)
+	require.NoError(t, err)
+	require.Equal(t, tr.Root(), reopened.Root())
+	require.Equal(t, tr.Pages.Len(), reopened.Pages.Len())
+
+	numPages := 0
+	require.NoError(t, reopened.Pages.Range(func(path []byte, page *Page) bool {
+		require.Equal(t, expected.Pages.Page(path).Nodes, page.Nodes)
+		numPages++
+		return true
+	}))
+	require.Equal(t, expected.Pages.Len(), numPages)
+
+	tr = reopened
+	var valBuf [MaxInlineValueLen]byte
+	key := sha3.Sum256([]byte("key-1999"))
+	val, ok := tr.Get(key[:], valBuf[:])
+	require.True(t, ok)
+	require.Equal(t, []byte("value-1999"), val)
+
+	batch(2_000, 3_000)
+}
+
+func TestOpenTreeUnhashed(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := OpenTree(dir)
+	require.NoError(t, err)
+	_, err = tr.Commit(testBatch(0, 100))
+	require.NoError(t, err)
+
+	// Changes not yet hashed are hashed when the tree is closed.
+	key := []byte{1}
+	require.NoError(t, tr.Put(key, []byte("changed")))
+	require.NoError(t, tr.Close())
+	expected := NewTree()
+	_, err = expected.Commit(testBatch(0, 100))
+	require.NoError(t, err)
+	require.NoError(t, expected.Put(key, []byte("changed")))
+
+	tr, err = OpenTree(dir)
+	require.NoError(t, err)
+	root := tr.Root()
+	require.Equal(t, expected.Root(), root)
+	val, ok := tr.Get(key, nil)
+	require.True(t, ok)
+	proof, ok := tr.Prove(key)
+	require.True(t, ok)
+	require.True(t, VerifyProof(root, key, val, proof))
+	require.NoError(t, tr.Close())
+}
+
+func TestOpenTreeUnclean(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := OpenTree(dir)
+	require.NoError(t, err)
+
+	values := make(map[string][]byte)
+	put := func(from, to int) {
+		var keys [][]byte
+		for i := from; i < to; i++ {
+			key := sha3.Sum256([]byte(fmt.Sprintf("key-%d", i)))
+			value := bytes.Repeat([]byte{byte(i)}, i%200)
+			if i%100 == 0 {
+				// Overflow chunks must be recovered too.
+				value = bytes.Repeat([]byte{byte(i)}, 1_000+i)
+			}
+			tr.Put(key[:], value)
+			values[string(key[:])] = value
+			keys = append(keys, key[:])
+		}
+		slices.SortFunc(keys, bytes.Compare)
+		tr.Hash(keys)
+	}
+
+	put(0, 1_000)
+	require.NoError(t, tr.Flush())
+	inUse := tr.Datastore.InUse()
+	// Simulate a crash by not closing the tree.
+	require.NoError(t, tr.Datastore.file.Close())
+
+	tr, err = OpenTree(dir)
+	require.NoError(t, err)
+	require.Equal(t, inUse, tr.Datastore.InUse())
+
+	// Chunks in use must not be handed out again.
+	put(1_000, 2_000)
+	var valBuf [MaxInlineValueLen]byte
+	for key, value := range values {
+		val, ok := tr.Get([]byte(key), valBuf[:])
+		require.True(t, ok)
+		require.Equal(t, value, val)
+	}
+	require.NoError(t, tr.Close())
+}
+
+func TestMemPageStore(t *testing.T) {
+	r := rand.New(rand.NewSource(6))
+	s := newMemPageStore()
+	expected := map[string]*Page{"": s.Page(nil)}
+	for i := 0; i < 20_000; i++ {
+		path := make([]byte, r.Intn(MaxKeyLenPadded))
+		for j := range path {
+			path[j] = byte(r.Intn(1 << fullBits))
+		}
+		if r.Intn(4) == 0 {
+			// Delete short paths, which are likely to have been put.
+			path = path[:min(len(path), 1)]
+			if page := s.Page(path); page != nil {
+				s.Delete(path)
+				s.freePage(page)
+			}
+			delete(expected, string(path))
+		} else {
+			page := s.newPage()
+			page.Nodes[0][0] = byte(i)
+			s.Put(path, page)
+			expected[string(path)] = page
+		}
+		require.Equal(t, len(expected), s.Len())
+	}
+
+	for path, page := range expected {
+		require.Same(t, page, s.Page([]byte(path)))
+	}
+	numPages := 0
+	require.NoError(t, s.Range(func(path []byte, page *Page) bool {
+		require.Same(t, expected[string(path)], page)
+		numPages++
+		return true
+	}))
+	require.Equal(t, len(expected), numPages)
+
+	var path [MaxKeyLenPadded - 1]byte
+	page := s.Page(nil)
+	require.Zero(t, testing.AllocsPerRun(100, func() {
+		s.Page(path[:])
+		s.Put(nil, page)
+	}))
+}
+
+func TestPageID(t *testing.T) {
+	r := rand.New(rand.NewSource(8))
+	longest := bytes.Repeat([]byte{1<<fullBits - 1}, MaxKeyLenPadded-1)
+	require.Equal(t, longest, newPageID(longest).path())
+	require.Empty(t, newPageID(nil).path())
+
+	ids := make(map[pageID]string)
+	for i := 0; i < 10_000; i++ {
+		path := make([]byte, r.Intn(4))
+		for j := range path {
+			path[j] = byte(r.Intn(1 << fullBits))
+		}
+		id := newPageID(path)
+		require.Equal(t, string(path), string(id.path()))
+		if other, ok := ids[id]; ok {
+			require.Equal(t, other, string(path))
+		}
+		ids[id] = string(path)
+	}
+}
+
+func TestOpenTreeDirPageStore(t *testing.T) {
+	// Trees created before pages were stored in buckets keep theirs in a directory.
+	dir := t.TempDir()
+	_, err := OpenDirPageStore(filepath.Join(dir, "pages"))
+	require.NoError(t, err)
+	tr, err := OpenTree(dir)
+	require.NoError(t, err)
+	require.IsType(t, &DirPageStore{}, tr.Pages)
+	_, err = tr.Commit(testBatch(0, 100))
+	require.NoError(t, err)
+	require.NoError(t, tr.Close())
+
+	tr, err = OpenTree(dir)
+	require.NoError(t, err)
+	requireBatch(t, tr, testBatch(0, 100), true)
+	require.NoError(t, tr.Close())
+}
+
+func TestPageStoreRangeReads(t *testing.T) {
+	dir := t.TempDir()
+	dirPages, err := OpenDirPageStore(filepath.Join(dir, "pages"))
+	require.NoError(t, err)
+	bucketPages, err := OpenBucketPageStore(filepath.Join(dir, "pages.ht"), 64)
+	require.NoError(t, err)
+	defer bucketPages.Close()
+
+	for _, s := range []PageStore{newMemPageStore(), dirPages, bucketPages} {
+		for i := byte(0); i < 8; i++ {
+			s.Put([]byte{i}, &Page{})
+			if i == 4 {
+				require.NoError(t, s.Flush())
+			}
+		}
+		// Pages can be read while ranging over them.
+		numPages := 0
+		require.NoError(t, s.Range(func(path []byte, page *Page) bool {
+			require.NotNil(t, s.Page(path))
+			numPages++
+			return true
+		}))
+		require.Equal(t, s.Len(), numPages)
+	}
+}
+
+func TestDirPageStoreReadError(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "pages"), 0o755))
+	tr, err := OpenTree(dir)
+	require.NoError(t, err)
+	_, err = tr.Commit(testBatch(0, 100))
+	require.NoError(t, err)
+	require.NoError(t, tr.Close())
+
+	// A page cut short cannot be read, unlike a missing one.
+	s, err := OpenDirPageStore(filepath.Join(dir, "pages"))
+	require.NoError(t, err)
+	require.Nil(t, s.Page([]byte{1, 2, 3}))
+	require.NoError(t, s.Err())
+	require.NoError(t, os.Truncate(s.fileName(""), 100))
+	require.NotNil(t, s.Page(nil))
+	require.Error(t, s.Err())
+	s.Put([]byte{1}, &Page{})
+	require.ErrorIs(t, s.Flush(), s.Err())
+
+	_, err = OpenTree(dir)
+	require.Error(t, err)
+}
@@ -0,0 +1,194 @@
+package nomt
+
+import (
+	"bytes"
+)
+
+// Proof is a Merkle inclusion proof for a single key.
+// Siblings holds the hash bytes of each sibling along the key's path,
+// starting next to the leaf and ending next to the root.
+type Proof struct {
+	Siblings [][]byte
+}
+
+// KeyValue is a key and the value stored under it.
+type KeyValue struct {
+	Key, Value []byte
+}
+
+// AbsenceProof is a Merkle proof that a key is not in the tree.
+// The key's path ends either at an empty slot or at a leaf holding a different key.
+type AbsenceProof struct {
+	Proof
+	// Leaf is the leaf the key's path ends at, or nil if it ends at an empty slot.
+	Leaf *KeyValue
+}
+
+// Prove returns a proof that key is in the tree under the root
+// returned by the last call to Root or Hash. It returns false if key is not present.
+func (t *Tree) Prove(key []byte) (*Proof, bool) {
+	if len(key) > t.maxKeyLen() {
+		return nil, false
+	}
+	var paddedKeyBuf [MaxKeyLenPadded]byte
+	paddedKey := paddedKeyBuf[:]
+	paddedKey, partialBits := PadKey(t.path(key), paddedKey)
+	pageIdx, pathLen, page := t.lookup(paddedKey, partialBits)
+	if pathLen == 0 {
+		return nil, false
+	}
+	node := &page.Nodes[indexOf(paddedKey[pageIdx], pathLen)]
+	if node.IsHash() {
+		return nil, false
+	}
+	var keyBuf [MaxHashedKeyLen]byte
+	if !bytes.Equal(node.AsLeafNode().GetKey(keyBuf[:], t.Datastore), key) {
+		return nil, false
+	}
+
+	return &Proof{Siblings: t.siblings(paddedKey, pageIdx, pathLen, page)}, true
+}
+
+// ProveAbsent returns a proof that key is not in the tree under the root
+// returned by the last call to Root or Hash. It returns false if key is present,
+// if it is empty, or if its path is a prefix of the paths of keys in the tree,
+// so that it ends at an internal node.
+func (t *Tree) ProveAbsent(key []byte) (*AbsenceProof, bool) {
+	if len(key) == 0 || len(key) > t.maxKeyLen() {
+		return nil, false
+	}
+	if t.root == Zero {
+		// The tree is empty.
+		return &AbsenceProof{}, true
+	}
+
+	var paddedKeyBuf [MaxKeyLenPadded]byte
+	paddedKey := paddedKeyBuf[:]
+	paddedKey, partialBits := PadKey(t.path(key), paddedKey)
+	pageIdx, pathLen, page := t.lookup(paddedKey, partialBits)
+
+	proof := &AbsenceProof{}
+	if pathLen == 0 || page.Nodes[indexOf(paddedKey[pageIdx], pathLen)].IsHash() {
+		if fullBits*pageIdx+int(pathLen) == pathDepth(paddedKey, partialBits) {
+			// Every node on the key's path is taken by an internal node.
+			return nil, false
+		}
+		// The path ends at the empty slot below the last node found.
+		pathLen++
+	} else {
+		var keyBuf [MaxHashedKeyLen]byte
+		var valBuf [MaxInlineValueLen]byte
+		leaf := page.Nodes[indexOf(paddedKey[pageIdx], pathLen)].AsLeafNode()
+		foundKey := leaf.GetKey(keyBuf[:], t.Datastore)
+		if bytes.Equal(foundKey, key) {
+			return nil, false
+		}
+		proof.Leaf = &KeyValue{
+			Key:   bytes.Clone(foundKey),
+			Value: bytes.Clone(leaf.GetValue(valBuf[:], t.Datastore)),
+		}
+	}
+	proof.Siblings = t.siblings(paddedKey, pageIdx, pathLen, page)
+	return proof, true
+}
+
+// siblings returns the hash bytes of the siblings of the node at pathLen in page
+// and of each of its ancestors, walking the same path as hash.
+func (t *Tree) siblings(paddedKey []byte, pageIdx int, pathLen byte, page *Page) [][]byte {
+	siblings := make([][]byte, 0, 6*pageIdx+int(pathLen))
+	var hashBytesBuf [maxHashBytesLen]byte
+	for {
+		// Siblings differ only in the last bit of their index.
+		sibling := &page.Nodes[indexOf(paddedKey[pageIdx], pathLen)^1]
+		pos := t.hashBytes(hashBytesBuf[:], sibling, t.Datastore)
+		siblings = append(siblings, bytes.Clone(hashBytesBuf[:pos]))
+
+		pathLen--
+		if pathLen == 0 {
+			if pageIdx == 0 {
+				return siblings
+			}
+			pageIdx--
+			page = t.page(paddedKey[:pageIdx])
+			pathLen = fullBits
+		}
+	}
+}
+
+// VerifyProof reports whether proof shows that key is set to value in the tree with the given root.
+func VerifyProof(root Node, key, value []byte, proof *Proof, opts ...Option) bool {
+	c := newConfig(opts)
+	if len(key) == 0 || len(key) > c.maxKeyLen() || len(value) > MaxValueLen {
+		return false
+	}
+	depth := len(proof.Siblings)
+	if depth == 0 || depth > fullBits*MaxKeyLenPadded {
+		return false
+	}
+	return bytes.Equal(c.hashUp(c.leafHashBytes(key, value), c.path(key), depth, proof.Siblings), root[:])
+}
+
+// VerifyAbsenceProof reports whether proof shows that key is not in the tree with the given root.
+func VerifyAbsenceProof(root Node, key []byte, proof *AbsenceProof, opts ...Option) bool {
+	c := newConfig(opts)
+	// The empty key is never in a tree, and a leaf holding it could pass for an empty node.
+	if len(key) == 0 {
+		return false
+	}
+	depth := len(proof.Siblings)
+	if depth == 0 {
+		return root == Zero
+	}
+	if len(key) > c.maxKeyLen() || depth > fullBits*MaxKeyLenPadded {
+		return false
+	}
+
+	path := c.path(key)
+	node := c.emptyHashBytes()
+	if leaf := proof.Leaf; leaf != nil {
+		if len(leaf.Key) == 0 || len(leaf.Key) > c.maxKeyLen() || len(leaf.Value) > MaxValueLen || bytes.Equal(leaf.Key, key) {
+			return false
+		}
+		// The leaf must sit on the key's path.
+		leafPath := c.path(leaf.Key)
+		for i := 0; i < depth; i++ {
+			if keyBit(leafPath, i) != keyBit(path, i) {
+				return false
+			}
+		}
+		node = c.leafHashBytes(leaf.Key, leaf.Value)
+	}
+	return bytes.Equal(c.hashUp(node, path, depth, proof.Siblings), root[:])
+}
+
+// hashUp hashes node, found at depth on the path given by key, together with siblings
+// and returns the hash bytes of the node len(siblings) levels above it,
+// or nil if a sibling is malformed.
+func (c *config) hashUp(node, key []byte, depth int, siblings [][]byte) []byte {
+	var hashBytesBuf [2 * maxHashBytesLen]byte
+	for i, sibling := range siblings {
+		if c.domainSeparated && len(sibling) != len(Node{}) {
+			return nil
+		}
+		pos := 0
+		if keyBit(key, depth-1-i) == 0 {
+			pos += copy(hashBytesBuf[pos:], node)
+			pos += copy(hashBytesBuf[pos:], sibling)
+		} else {
+			pos += copy(hashBytesBuf[pos:], sibling)
+			pos += copy(hashBytesBuf[pos:], node)
+		}
+		parent := c.hashInternal(hashBytesBuf[:pos])
+		node = parent[:]
+	}
+	return node
+}
+
+// keyBit returns the bit of key at the given depth (0 is the most significant bit).
+// Bits past the end of the key are 0, matching the padding added by PadKey.
+func keyBit(key []byte, depth int) byte {
+	if depth/8 >= len(key) {
+		return 0
+	}
+	return key[depth/8] >> (7 - depth%8) & 1
+}
@@ -0,0 +1,158 @@
+package nomt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+)
+
+// randomTree returns a hashed tree holding numKeys random keys and values.
+func randomTree(numKeys int, opts ...Option) (*Tree, map[string][]byte) {
+	r := rand.New(rand.NewSource(1))
+	hasher := sha3.NewLegacyKeccak256()
+
+	tr := NewTree(opts...)
+	values := make(map[string][]byte)
+	var keys [][]byte
+	for i := 0; i < numKeys; i++ {
+		hasher.Write([]byte(fmt.Sprintf("key-%d", i)))
+		key := hasher.Sum(nil)
+		hasher.Reset()
+		value := make([]byte, r.Intn(256))
+		r.Read(value)
+
+		tr.Put(key, value)
+		values[string(key)] = value
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, bytes.Compare)
+	tr.Hash(keys)
+	return tr, values
+}
+
+func TestProve(t *testing.T) {
+	tr, values := randomTree(1_000)
+
+	for key, value := range values {
+		proof, ok := tr.Prove([]byte(key))
+		require.True(t, ok)
+		require.True(t, VerifyProof(tr.Root(), []byte(key), value, proof))
+
+		require.False(t, VerifyProof(tr.Root(), []byte(key), append(value, 0), proof))
+		require.False(t, VerifyProof(Node{0x80}, []byte(key), value, proof))
+	}
+
+	_, ok := tr.Prove([]byte("missing"))
+	require.False(t, ok)
+}
+
+func TestProveSingleKey(t *testing.T) {
+	tr := NewTree()
+	key, value := []byte("key"), []byte("value")
+	tr.Put(key, value)
+	root := mustHash(t, tr, [][]byte{key})
+
+	proof, ok := tr.Prove(key)
+	require.True(t, ok)
+	require.Len(t, proof.Siblings, 1)
+	require.True(t, VerifyProof(root, key, value, proof))
+	require.False(t, VerifyProof(root, []byte("kez"), value, proof))
+}
+
+func TestProveAbsent(t *testing.T) {
+	tr, values := randomTree(1_000)
+
+	var withLeaf, withEmpty int
+	for i := 0; i < 1_000; i++ {
+		hash := sha3.Sum256([]byte(fmt.Sprintf("absent-%d", i)))
+		key := hash[:]
+		proof, ok := tr.ProveAbsent(key)
+		require.True(t, ok)
+		require.True(t, VerifyAbsenceProof(tr.Root(), key, proof))
+		require.False(t, VerifyAbsenceProof(Node{0x80}, key, proof))
+
+		if proof.Leaf == nil {
+			withEmpty++
+			continue
+		}
+		withLeaf++
+		require.Equal(t, values[string(proof.Leaf.Key)], proof.Leaf.Value)
+		// The same proof can not be used to show the leaf's own key is absent.
+		require.False(t, VerifyAbsenceProof(tr.Root(), proof.Leaf.Key, proof))
+	}
+	require.NotZero(t, withLeaf)
+	require.NotZero(t, withEmpty)
+
+	for key := range values {
+		_, ok := tr.ProveAbsent([]byte(key))
+		require.False(t, ok)
+	}
+}
+
+func TestProveAbsentPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		keys   [][]byte
+		prefix []byte
+	}{
+		// The prefix's path ends at the bottom of a page.
+		{[][]byte{{0x0a, 0, 0, 0, 0, 1}, {0x0a, 0, 0, 0, 0, 2}}, []byte{0x0a, 0, 0}},
+		// The prefix's path ends within a page.
+		{[][]byte{{0x0a, 0, 1}, {0x0a, 0, 2}}, []byte{0x0a}},
+	} {
+		tr := NewTree()
+		for _, key := range tt.keys {
+			require.NoError(t, tr.Put(key, []byte("value")))
+		}
+		root := tr.Root()
+		_, ok := tr.ProveAbsent(tt.prefix)
+		require.False(t, ok, "prefix %x", tt.prefix)
+
+		// Keys branching off the internal nodes are still proven absent.
+		key := append(bytes.Clone(tt.prefix[:len(tt.prefix)-1]), 0x8a)
+		proof, ok := tr.ProveAbsent(key)
+		require.True(t, ok)
+		require.True(t, VerifyAbsenceProof(root, key, proof))
+	}
+}
+
+func TestProveAbsentEmptyTree(t *testing.T) {
+	tr := NewTree()
+	proof, ok := tr.ProveAbsent([]byte("key"))
+	require.True(t, ok)
+	require.True(t, VerifyAbsenceProof(tr.Root(), []byte("key"), proof))
+
+	tr.Put([]byte("key"), []byte("value"))
+	root := mustHash(t, tr, [][]byte{[]byte("key")})
+	require.False(t, VerifyAbsenceProof(root, []byte("key"), proof))
+}
+
+func TestEmptyKey(t *testing.T) {
+	tr := NewTree()
+	require.ErrorIs(t, tr.Put(nil, nil), ErrEmptyKey)
+	require.ErrorIs(t, tr.Overlay().Put(nil, nil), ErrEmptyKey)
+	batch := &Batch{}
+	batch.Put(nil, nil)
+	_, err := tr.Commit(batch)
+	require.ErrorIs(t, err, ErrEmptyKey)
+
+	// The leaf of the empty key with an empty value hashes like an empty node,
+	// so proofs about the empty key could be forged from those of other keys.
+	key, value := []byte{0x80}, []byte("value")
+	require.NoError(t, tr.Put(key, value))
+	root := tr.Root()
+	proof, ok := tr.Prove(key)
+	require.True(t, ok)
+	require.Equal(t, tr.emptyHashBytes(), tr.leafHashBytes(nil, nil))
+	forged := &Proof{Siblings: [][]byte{tr.leafHashBytes(key, value)}}
+	require.False(t, VerifyProof(root, nil, nil, forged))
+	require.False(t, VerifyAbsenceProof(root, nil, &AbsenceProof{Proof: *forged}))
+	require.False(t, VerifyAbsenceProof(root, []byte{0x00}, &AbsenceProof{Proof: *forged, Leaf: &KeyValue{}}))
+	_, ok = tr.ProveAbsent(nil)
+	require.False(t, ok)
+	require.True(t, VerifyProof(root, key, value, proof))
+}
@@ -0,0 +1,278 @@
+package nomt
+
+import (
+	"bytes"
+)
+
+// RangeProof is a Merkle proof that a tree holds exactly the given leaves
+// among the keys whose paths are in [start, end).
+// Subtrees entirely inside the range are rebuilt from the leaves, subtrees
+// entirely outside it are given by their hash bytes, and the nodes on the
+// paths of start and end are walked down to where those paths end.
+type RangeProof struct {
+	// Leaves holds the keys in the range and their values, in the order of their paths.
+	Leaves []KeyValue
+	// Start and End tell where the paths of start and end end in the tree.
+	// Each is the zero value if its bound is nil.
+	Start, End RangeBoundary
+	// Siblings holds the hash bytes of the subtrees outside the range,
+	// in the order a depth-first walk of the range needs them.
+	Siblings [][]byte
+}
+
+// RangeBoundary is where the path of a bound of a RangeProof ends:
+// at an empty slot or at a leaf.
+type RangeBoundary struct {
+	Depth int
+	// Leaf is the leaf the path ends at if it is outside the range, or nil.
+	// Leaves inside the range are in the proof's Leaves instead.
+	Leaf *KeyValue
+}
+
+// ProveRange returns the keys whose paths are in [start, end), along with a
+// proof that no others are in the tree under the root returned by the last
+// call to Root or Hash. A nil start or end leaves that side of the range unbounded.
+// In trees created WithHashedKeys, start and end bound the hashes of keys.
+// It returns false if start is not before end. A range holding no keys
+// gets a proof with no Leaves, showing that it is empty.
+func (t *Tree) ProveRange(start, end []byte) (*RangeProof, bool) {
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return nil, false
+	}
+	proof := &RangeProof{}
+	if t.root == Zero {
+		// The tree is empty.
+		return proof, true
+	}
+	p := rangeProver{Iterator: t.Iterator(start, end), proof: proof}
+	p.children(0, start != nil, end != nil)
+	return proof, true
+}
+
+// rangeProver walks the nodes of a range, using the path of its Iterator
+// to find them.
+type rangeProver struct {
+	*Iterator
+	proof *RangeProof
+}
+
+// children adds what is needed to verify the children of the internal node
+// at depth, which is on the path of start if onStart, and of end if onEnd.
+func (p *rangeProver) children(depth int, onStart, onEnd bool) {
+	for bit := byte(0); bit <= 1; bit++ {
+		p.setBit(depth+1, bit)
+		if onStart && bit < keyBit(p.start, depth) || onEnd && bit > keyBit(p.end, depth) {
+			// The child is outside the range.
+			var hashBytesBuf [maxHashBytesLen]byte
+			pos := p.t.hashBytes(hashBytesBuf[:], p.nodeAt(depth+1), p.t.Datastore)
+			p.proof.Siblings = append(p.proof.Siblings, bytes.Clone(hashBytesBuf[:pos]))
+			continue
+		}
+		p.node(depth+1, onStart && bit == keyBit(p.start, depth), onEnd && bit == keyBit(p.end, depth))
+	}
+}
+
+// node adds what is needed to verify the node at depth (> 0), which is
+// on the path of start if onStart, and of end if onEnd, and otherwise inside the range.
+func (p *rangeProver) node(depth int, onStart, onEnd bool) {
+	node := p.nodeAt(depth)
+	switch {
+	case !onStart && !onEnd:
+		p.leaves(depth, node)
+	case node.IsHash():
+		p.children(depth, onStart, onEnd)
+	default:
+		// The bounds' paths end here.
+		if onStart {
+			p.proof.Start.Depth = depth
+		}
+		if onEnd {
+			p.proof.End.Depth = depth
+		}
+		if node.IsZero() {
+			return
+		}
+		leaf := p.keyValue(node)
+		path := p.t.path(leaf.Key)
+		switch {
+		case p.start != nil && bytes.Compare(path, p.start) < 0:
+			p.proof.Start.Leaf = &leaf
+		case p.end != nil && bytes.Compare(path, p.end) >= 0:
+			p.proof.End.Leaf = &leaf
+		default:
+			p.proof.Leaves = append(p.proof.Leaves, leaf)
+		}
+	}
+}
+
+// leaves adds the leaves below the node at depth, which is inside the range.
+func (p *rangeProver) leaves(depth int, node *Node) {
+	switch {
+	case node.IsZero():
+	case node.IsHash():
+		for bit := byte(0); bit <= 1; bit++ {
+			p.setBit(depth+1, bit)
+			p.leaves(depth+1, p.nodeAt(depth+1))
+		}
+	default:
+		p.proof.Leaves = append(p.proof.Leaves, p.keyValue(node))
+	}
+}
+
+func (p *rangeProver) keyValue(node *Node) KeyValue {
+	leaf := node.AsLeafNode()
+	return KeyValue{
+		Key:   bytes.Clone(leaf.GetKey(p.keyBuf[:], p.t.Datastore)),
+		Value: leaf.GetValue(nil, p.t.Datastore),
+	}
+}
+
+// VerifyRangeProof reports whether proof shows that the keys whose paths are
+// in [start, end) in the tree with the given root are exactly proof.Leaves.
+func VerifyRangeProof(root Node, start, end []byte, proof *RangeProof, opts ...Option) bool {
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return false
+	}
+	if root == Zero {
+		return len(proof.Leaves) == 0 && len(proof.Siblings) == 0 &&
+			proof.Start == (RangeBoundary{}) && proof.End == (RangeBoundary{})
+	}
+	for _, b := range []struct {
+		bound    []byte
+		boundary RangeBoundary
+	}{{start, proof.Start}, {end, proof.End}} {
+		if b.bound == nil && b.boundary != (RangeBoundary{}) ||
+			b.bound != nil && (b.boundary.Depth <= 0 || b.boundary.Depth > fullBits*MaxKeyLenPadded) {
+			return false
+		}
+	}
+
+	c := newConfig(opts)
+	paths := make([][]byte, len(proof.Leaves))
+	for i, leaf := range proof.Leaves {
+		if len(leaf.Key) == 0 || len(leaf.Key) > c.maxKeyLen() || len(leaf.Value) > MaxValueLen {
+			return false
+		}
+		paths[i] = c.path(leaf.Key)
+		if i > 0 && bytes.Compare(paths[i-1], paths[i]) >= 0 {
+			return false
+		}
+		if start != nil && bytes.Compare(paths[i], start) < 0 || end != nil && bytes.Compare(paths[i], end) >= 0 {
+			return false
+		}
+	}
+	v := rangeVerifier{config: &c, proof: proof, start: start, end: end, siblings: proof.Siblings}
+	node, ok := v.children(paths, proof.Leaves, 0, start != nil, end != nil)
+	return ok && len(v.siblings) == 0 && bytes.Equal(node, root[:])
+}
+
+type rangeVerifier struct {
+	*config
+	proof      *RangeProof
+	start, end []byte
+	siblings   [][]byte // siblings not yet used
+}
+
+// children returns the hash bytes of the internal node at depth, assuming
+// leaves, found at paths, are exactly the leaves in the range below it.
+// The node is on the path of start if onStart, and of end if onEnd.
+func (v *rangeVerifier) children(paths [][]byte, leaves []KeyValue, depth int, onStart, onEnd bool) ([]byte, bool) {
+	if depth >= fullBits*MaxKeyLenPadded {
+		return nil, false
+	}
+	mid := splitKeys(paths, depth)
+	var data []byte
+	for bit := byte(0); bit <= 1; bit++ {
+		childPaths, childLeaves := paths[:mid], leaves[:mid]
+		if bit == 1 {
+			childPaths, childLeaves = paths[mid:], leaves[mid:]
+		}
+		if onStart && bit < keyBit(v.start, depth) || onEnd && bit > keyBit(v.end, depth) {
+			// The child is outside the range.
+			if len(childLeaves) > 0 || len(v.siblings) == 0 {
+				return nil, false
+			}
+			sibling := v.siblings[0]
+			v.siblings = v.siblings[1:]
+			if v.domainSeparated && len(sibling) != len(Node{}) {
+				return nil, false
+			}
+			data = append(data, sibling...)
+			continue
+		}
+		child, ok := v.node(childPaths, childLeaves, depth+1, onStart && bit == keyBit(v.start, depth), onEnd && bit == keyBit(v.end, depth))
+		if !ok {
+			return nil, false
+		}
+		data = append(data, child...)
+	}
+	parent := v.hashInternal(data)
+	return parent[:], true
+}
+
+// node returns the hash bytes of the node at depth (> 0), as children does.
+func (v *rangeVerifier) node(paths [][]byte, leaves []KeyValue, depth int, onStart, onEnd bool) ([]byte, bool) {
+	atStart := onStart && depth == v.proof.Start.Depth
+	atEnd := onEnd && depth == v.proof.End.Depth
+	switch {
+	case !onStart && !onEnd:
+		return v.subtree(paths, leaves, depth)
+	case onStart && onEnd && atStart != atEnd:
+		return nil, false
+	case !atStart && !atEnd:
+		return v.children(paths, leaves, depth, onStart, onEnd)
+	}
+
+	// The bounds' paths end here, at an empty slot or a leaf.
+	var leaf *KeyValue
+	if atStart && v.proof.Start.Leaf != nil {
+		leaf = v.proof.Start.Leaf
+		if !v.boundaryLeaf(leaf, v.start, depth) || bytes.Compare(v.path(leaf.Key), v.start) >= 0 {
+			return nil, false
+		}
+	}
+	if atEnd && v.proof.End.Leaf != nil {
+		if leaf != nil {
+			return nil, false
+		}
+		leaf = v.proof.End.Leaf
+		if !v.boundaryLeaf(leaf, v.end, depth) || bytes.Compare(v.path(leaf.Key), v.end) < 0 {
+			return nil, false
+		}
+	}
+	switch {
+	case leaf == nil && len(leaves) <= 1:
+		return v.subtree(paths, leaves, depth)
+	case leaf != nil && len(leaves) == 0:
+		return v.leafHashBytes(leaf.Key, leaf.Value), true
+	}
+	return nil, false
+}
+
+// boundaryLeaf reports whether leaf is well formed and its path shares
+// the first depth bits of bound's.
+func (v *rangeVerifier) boundaryLeaf(leaf *KeyValue, bound []byte, depth int) bool {
+	if len(leaf.Key) == 0 || len(leaf.Key) > v.maxKeyLen() || len(leaf.Value) > MaxValueLen {
+		return false
+	}
+	path := v.path(leaf.Key)
+	for i := 0; i < depth; i++ {
+		if keyBit(path, i) != keyBit(bound, i) {
+			return false
+		}
+	}
+	return true
+}
+
+// subtree returns the hash bytes of the node at depth (> 0) inside the range,
+// assuming leaves, found at paths, are exactly the leaves below it.
+func (v *rangeVerifier) subtree(paths [][]byte, leaves []KeyValue, depth int) ([]byte, bool) {
+	switch len(leaves) {
+	case 0:
+		return v.emptyHashBytes(), true
+	case 1:
+		// A lone leaf sits as high as it can.
+		return v.leafHashBytes(leaves[0].Key, leaves[0].Value), true
+	}
+	return v.children(paths, leaves, depth, false, false)
+}
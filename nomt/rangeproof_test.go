@@ -0,0 +1,85 @@
+package nomt
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProveRange(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	for _, opts := range [][]Option{nil, {WithHashedKeys()}, {WithDomainSeparation()}} {
+		tr, paths, values := iteratorTestTree(t, opts...)
+		root := tr.Root()
+
+		bound := func() []byte {
+			switch r.Intn(4) {
+			case 0:
+				return nil
+			case 1:
+				return bytes.Clone(paths[r.Intn(len(paths))])
+			}
+			b := make([]byte, r.Intn(4))
+			r.Read(b)
+			return b
+		}
+		for i := 0; i < 200; i++ {
+			start, end := bound(), bound()
+			if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+				_, ok := tr.ProveRange(start, end)
+				require.False(t, ok)
+				continue
+			}
+			proof, ok := tr.ProveRange(start, end)
+			require.True(t, ok)
+			require.True(t, VerifyRangeProof(root, start, end, proof, opts...), "range [%x, %x)", start, end)
+
+			var expected [][]byte
+			for _, path := range paths {
+				if (start == nil || bytes.Compare(path, start) >= 0) && (end == nil || bytes.Compare(path, end) < 0) {
+					expected = append(expected, path)
+				}
+			}
+			got := make([][]byte, len(proof.Leaves))
+			for j, leaf := range proof.Leaves {
+				require.Equal(t, values[string(leaf.Key)], leaf.Value)
+				got[j] = tr.path(leaf.Key)
+			}
+			if expected == nil {
+				require.Empty(t, got)
+			} else {
+				require.Equal(t, expected, got)
+			}
+
+			// Leaves cannot be left out or changed.
+			if n := len(proof.Leaves); n > 0 {
+				j := r.Intn(n)
+				leaves := proof.Leaves
+				proof.Leaves = append(leaves[:j:j], leaves[j+1:]...)
+				require.False(t, VerifyRangeProof(root, start, end, proof, opts...))
+				proof.Leaves = leaves
+
+				value := leaves[j].Value
+				leaves[j].Value = append(bytes.Clone(value), 0)
+				require.False(t, VerifyRangeProof(root, start, end, proof, opts...))
+				leaves[j].Value = value
+			}
+			// The proof is only good for its range.
+			if start != nil {
+				require.False(t, VerifyRangeProof(root, nil, end, proof, opts...))
+			}
+		}
+	}
+}
+
+func TestProveRangeEmptyTree(t *testing.T) {
+	tr := NewTree()
+	proof, ok := tr.ProveRange(nil, []byte{1})
+	require.True(t, ok)
+	require.True(t, VerifyRangeProof(tr.Root(), nil, []byte{1}, proof))
+
+	tr.Put([]byte{0}, []byte{1})
+	require.False(t, VerifyRangeProof(tr.Root(), nil, []byte{1}, proof))
+}
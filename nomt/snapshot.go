@@ -0,0 +1,196 @@
+package nomt
+
+// Snapshot is a read-only view of a Tree, frozen at the root the tree had
+// when the snapshot was taken. It can be read while the tree is changed.
+//
+// Snapshots share pages and chunks with their tree. When the tree is about to
+// change a page a snapshot still reads, the snapshot keeps the page and the
+// tree changes a copy, and the chunks of the page's leaves are not freed or
+// written to until the snapshot is released.
+type Snapshot struct {
+	tree  *Tree
+	pages *snapshotPages
+}
+
+// Snapshot returns a snapshot of the tree at its current root,
+// first rehashing any keys changed since the last call to Root or Hash.
+// The snapshot must be released with Release once it is no longer needed.
+func (t *Tree) Snapshot() *Snapshot {
+	root := t.Root()
+	pages := &snapshotPages{t: t, saved: make(map[string]*Page)}
+	t.snapshots = append(t.snapshots, pages)
+	return &Snapshot{
+		tree: &Tree{
+			Pages:     pages,
+			Datastore: t.Datastore,
+			config:    t.config,
+			root:      root,
+		},
+		pages: pages,
+	}
+}
+
+// Release frees the pages and chunks only the snapshot still references.
+// The snapshot must not be used afterwards. Release must not be called
+// concurrently with changes to the tree.
+func (s *Snapshot) Release() {
+	t := s.pages.t
+	i := 0
+	for i < len(t.snapshots) && t.snapshots[i] != s.pages {
+		i++
+	}
+	if i == len(t.snapshots) {
+		// Already released.
+		return
+	}
+	t.snapshots = append(t.snapshots[:i], t.snapshots[i+1:]...)
+	for path, page := range s.pages.saved {
+		if page == nil {
+			continue
+		}
+		page.chunks(t.Datastore, t.Datastore.Free)
+		if !t.saved(path, page) {
+			t.freePage(page)
+		}
+	}
+	s.pages.saved = nil
+}
+
+// Root returns the root of the tree when the snapshot was taken.
+func (s *Snapshot) Root() Node {
+	return s.tree.root
+}
+
+// Get is Tree.Get, for the snapshot.
+func (s *Snapshot) Get(key []byte, valBuf []byte) ([]byte, bool) {
+	return s.tree.Get(key, valBuf)
+}
+
+// Iterator is Tree.Iterator, for the snapshot.
+func (s *Snapshot) Iterator(start, end []byte) *Iterator {
+	return s.tree.Iterator(start, end)
+}
+
+// ScanPrefix is Tree.ScanPrefix, for the snapshot.
+func (s *Snapshot) ScanPrefix(prefix []byte, fn func(key, value []byte) bool) {
+	s.tree.ScanPrefix(prefix, fn)
+}
+
+// Prove is Tree.Prove, for the snapshot's root.
+func (s *Snapshot) Prove(key []byte) (*Proof, bool) {
+	return s.tree.Prove(key)
+}
+
+// ProveAbsent is Tree.ProveAbsent, for the snapshot's root.
+func (s *Snapshot) ProveAbsent(key []byte) (*AbsenceProof, bool) {
+	return s.tree.ProveAbsent(key)
+}
+
+// ProveMany is Tree.ProveMany, for the snapshot's root.
+func (s *Snapshot) ProveMany(keys [][]byte) (*MultiProof, bool) {
+	return s.tree.ProveMany(keys)
+}
+
+// ProveRange is Tree.ProveRange, for the snapshot's root.
+func (s *Snapshot) ProveRange(start, end []byte) (*RangeProof, bool) {
+	return s.tree.ProveRange(start, end)
+}
+
+// snapshotPages is the PageStore of a snapshot. It reads pages from its tree,
+// except for those the tree has replaced since the snapshot was taken.
+type snapshotPages struct {
+	t     *Tree
+	saved map[string]*Page // the snapshot's pages the tree replaced, nil for ones it added
+}
+
+// preserve saves old, the page at path, in each snapshot that still reads
+// the page at path from the tree, and reports whether there was any.
+// It must be called with snapshotMu held, before the page at path is replaced.
+func (t *Tree) preserve(path []byte, old *Page) bool {
+	preserved := false
+	for _, s := range t.snapshots {
+		if _, ok := s.saved[string(path)]; ok {
+			continue
+		}
+		s.saved[string(path)] = old
+		if old != nil {
+			// The tree's leaves may be freed, while the snapshot's must not be.
+			old.chunks(t.Datastore, t.Datastore.ref)
+		}
+		preserved = true
+	}
+	return preserved
+}
+
+// saved reports whether a snapshot saved page, replaced at path in the tree.
+// Snapshots taken before the page was replaced all save it.
+func (t *Tree) saved(path string, page *Page) bool {
+	for _, s := range t.snapshots {
+		if s.saved[path] == page {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *snapshotPages) Page(path []byte) *Page {
+	s.t.snapshotMu.RLock()
+	defer s.t.snapshotMu.RUnlock()
+	if page, ok := s.saved[string(path)]; ok {
+		return page
+	}
+	return s.t.Pages.Page(path)
+}
+
+func (s *snapshotPages) Put(path []byte, page *Page) {
+	panic("nomt: snapshots are read-only")
+}
+
+func (s *snapshotPages) Delete(path []byte) {
+	panic("nomt: snapshots are read-only")
+}
+
+func (s *snapshotPages) Len() int {
+	n := 0
+	s.Range(func([]byte, *Page) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// Range collects the snapshot's pages before calling fn, so that fn
+// is called without snapshotMu held.
+func (s *snapshotPages) Range(fn func(path []byte, page *Page) bool) error {
+	type entry struct {
+		path []byte
+		page *Page
+	}
+	var entries []entry
+	s.t.snapshotMu.RLock()
+	for path, page := range s.saved {
+		if page != nil {
+			entries = append(entries, entry{[]byte(path), page})
+		}
+	}
+	err := s.t.Pages.Range(func(path []byte, page *Page) bool {
+		if _, ok := s.saved[string(path)]; !ok {
+			entries = append(entries, entry{path, page})
+		}
+		return true
+	})
+	s.t.snapshotMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !fn(e.path, e.page) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *snapshotPages) Flush() error {
+	return nil
+}
@@ -0,0 +1,171 @@
+package nomt
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+)
+
+// snapshotTestValue returns the value of the i-th test key in a given round,
+// with some values long enough to be stored in overflow chunks.
+func snapshotTestValue(i, round int) []byte {
+	if i%50 == 0 {
+		return bytes.Repeat([]byte{byte(round)}, 300+i)
+	}
+	return []byte(fmt.Sprintf("value-%d-%d", i, round))
+}
+
+// requireSnapshot checks that s holds exactly values and proves them under its root.
+func requireSnapshot(t *testing.T, s *Snapshot, values map[string][]byte) {
+	for key, value := range values {
+		val, ok := s.Get([]byte(key), nil)
+		require.True(t, ok)
+		require.Equal(t, value, val)
+	}
+	n := 0
+	it := s.Iterator(nil, nil)
+	for ok := it.First(); ok; ok = it.Next() {
+		require.Equal(t, values[string(it.Key())], it.Value())
+		n++
+	}
+	require.Equal(t, len(values), n)
+
+	for key, value := range values {
+		proof, ok := s.Prove([]byte(key))
+		require.True(t, ok)
+		require.True(t, VerifyProof(s.Root(), []byte(key), value, proof))
+		break
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	tr := NewTree()
+	inUse := tr.Datastore.InUse()
+	key := func(i int) []byte {
+		key := sha3.Sum256([]byte(fmt.Sprintf("key-%d", i)))
+		return key[:]
+	}
+
+	var snapshots []*Snapshot
+	var snapshotValues []map[string][]byte
+	values := make(map[string][]byte)
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 1_000; i++ {
+			switch {
+			case (i+round)%7 == 0:
+				if tr.Delete(key(i)) {
+					delete(values, string(key(i)))
+				}
+			case (i+round)%3 != 0:
+				require.NoError(t, tr.Put(key(i), snapshotTestValue(i, round)))
+				values[string(key(i))] = snapshotTestValue(i, round)
+			}
+		}
+		if round%2 == 1 {
+			tr.Root()
+		}
+		snapshots = append(snapshots, tr.Snapshot())
+		snapshotValues = append(snapshotValues, maps.Clone(values))
+	}
+	require.Equal(t, tr.Root(), snapshots[len(snapshots)-1].Root())
+
+	// Snapshots are unaffected by later changes, and by releasing other snapshots.
+	for i, s := range snapshots {
+		requireSnapshot(t, s, snapshotValues[i])
+	}
+	snapshots[1].Release()
+	snapshots[1].Release()
+	for _, i := range []int{0, 2, 3} {
+		requireSnapshot(t, snapshots[i], snapshotValues[i])
+	}
+
+	// Once all snapshots are released, only the tree's chunks are in use.
+	for _, s := range snapshots {
+		s.Release()
+	}
+	for i := 0; i < 1_000; i++ {
+		tr.Delete(key(i))
+	}
+	require.Equal(t, inUse, tr.Datastore.InUse())
+	require.Empty(t, tr.Datastore.refs)
+}
+
+func TestSnapshotConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := OpenTree(dir)
+	require.NoError(t, err)
+	values := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		key := sha3.Sum256([]byte(fmt.Sprintf("key-%d", i)))
+		require.NoError(t, tr.Put(key[:], snapshotTestValue(i, 0)))
+		values[string(key[:])] = snapshotTestValue(i, 0)
+	}
+	s := tr.Snapshot()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1_000; i++ {
+			key := sha3.Sum256([]byte(fmt.Sprintf("key-%d", i)))
+			if i%4 == 0 {
+				tr.Delete(key[:])
+			} else {
+				require.NoError(t, tr.Put(key[:], snapshotTestValue(i, 1)))
+			}
+			if i%100 == 0 {
+				tr.Root()
+				require.NoError(t, tr.Flush())
+			}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		requireSnapshot(t, s, values)
+	}
+	wg.Wait()
+	requireSnapshot(t, s, values)
+	s.Release()
+	require.NoError(t, tr.Close())
+}
+
+func TestSnapshotHashParallel(t *testing.T) {
+	// Pages are copied for the snapshot by concurrent workers even on one CPU.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	tr := NewTree()
+	serial := NewTree()
+	serial.HashSplitDepth = 0
+	key := func(i int) []byte {
+		key := sha3.Sum256([]byte(fmt.Sprintf("key-%d", i)))
+		return key[:]
+	}
+	values := make(map[string][]byte)
+	for i := 0; i < 5_000; i++ {
+		require.NoError(t, tr.Put(key(i), snapshotTestValue(i, 0)))
+		require.NoError(t, serial.Put(key(i), snapshotTestValue(i, 0)))
+		values[string(key(i))] = snapshotTestValue(i, 0)
+	}
+	require.Equal(t, serial.Root(), tr.Root())
+
+	for round := 1; round <= 10; round++ {
+		s := tr.Snapshot()
+		snapshotValues := maps.Clone(values)
+
+		// Updating keys changes the pages of their leaves only, leaving the
+		// pages above them to be copied for the snapshot by parallel hashing.
+		for i := 0; i < 300; i++ {
+			n := (round*300 + i) % 5_000
+			require.NoError(t, tr.Put(key(n), snapshotTestValue(n, round)))
+			require.NoError(t, serial.Put(key(n), snapshotTestValue(n, round)))
+			values[string(key(n))] = snapshotTestValue(n, round)
+		}
+		require.Equal(t, serial.Root(), tr.Root())
+		requireSnapshot(t, s, snapshotValues)
+		s.Release()
+	}
+}
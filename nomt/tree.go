@@ -2,26 +2,58 @@ package nomt
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 )
 
 const (
-	MaxKeyLen       = 64
-	MaxValueLen     = 255
-	MaxKeyLenPadded = (MaxKeyLen*8 + 5) / 6
+	MaxKeyLen = 64
+	// MaxHashedKeyLen is the maximum length of a key in a tree created WithHashedKeys.
+	// Hash bytes starting with a key length of 127 would be mistaken
+	// by Node.HashBytes for those of an overflow leaf.
+	MaxHashedKeyLen = 126
+	MaxValueLen     = 16 << 20
+	// Values up to this length are stored in the chunks of their leaf,
+	// longer ones in overflow chunks.
+	MaxInlineValueLen = 255
+	MaxKeyLenPadded   = (MaxKeyLen*8 + 5) / 6
 )
 
 var Zero Node
 
+var (
+	// ErrKeyTooLong is returned for keys longer than MaxKeyLen,
+	// or MaxHashedKeyLen in trees created WithHashedKeys.
+	ErrKeyTooLong = errors.New("nomt: key too long")
+	// ErrEmptyKey is returned when putting the empty key. The hash bytes
+	// of its leaf with an empty value would be those of an empty node.
+	ErrEmptyKey = errors.New("nomt: empty key")
+	// ErrValueTooLong is returned for values longer than MaxValueLen.
+	ErrValueTooLong = errors.New("nomt: value too long")
+	// ErrUnsortedKeys is returned when keys that must be sorted are not.
+	ErrUnsortedKeys = errors.New("nomt: keys not sorted")
+	// ErrKeyPrefixConflict is returned when a key's path in the tree is a prefix
+	// of another key's path, as happens when one key is a prefix of the other.
+	// Trees created WithHashedKeys accept such keys.
+	ErrKeyPrefixConflict = errors.New("nomt: key path is a prefix of another key's path")
+)
+
 const fullBits = 6
 
 // Page is a 4KB block of data
 // Contains 128-2=126 merkle tree nodes of 32 bytes each
 // Root must be stored separately (or in the parent page)
-// Last 64 bytes are reserved for metadata.
+// Last 64 bytes are reserved for metadata: the page's ID,
+// set by the page stores that look pages up by it.
 type Page struct {
 	Nodes [126]Node
-	_     [64]byte
+	id    pageID
 }
 
 func (p *Page) print() {
@@ -30,6 +62,17 @@ func (p *Page) print() {
 	}
 }
 
+// chunks calls fn with the index of each chunk of each leaf in the page.
+func (p *Page) chunks(d *Datastore, fn func(idx uint32)) {
+	for i := range p.Nodes {
+		node := &p.Nodes[i]
+		if node.IsZero() || node.IsHash() {
+			continue
+		}
+		node.AsLeafNode().chunks(d, fn)
+	}
+}
+
 func (p *Page) nonZeroPathBitLen(query byte, bitLen byte) byte {
 	i := byte(0)
 	for i < bitLen {
@@ -47,7 +90,7 @@ func (p *Page) nonZeroPathBitLen(query byte, bitLen byte) byte {
 // - The upper 2 bits of the byte are set to 0.
 // Returns the padded key and the number of partial bits in the last byte.
 func PadKey(key, out []byte) ([]byte, int) {
-	_ = out[(len(key)*8+5)/6] // bounds check elimination, ceil(len(key)*8/6) == len(out)
+	_ = out[len(key)*8/6] // bounds check elimination, the returned key ends at len(key)*8/6
 	idx := 0
 	for i, k := range key {
 		switch i % 3 {
@@ -75,19 +118,292 @@ func indexOf(query byte, bitLen byte) int {
 	return int(idx - 2)
 }
 
+// Tree is a Merkle tree of keys and values, stored in pages of nodes.
+//
+// A Tree is not safe for concurrent use: its methods must all be called from
+// one goroutine at a time, the writer. Readers on other goroutines can read
+// snapshots taken by the writer, and, in trees created WithConcurrentReads,
+// the last committed version through View.
 type Tree struct {
-	Root      Node
-	Pages     map[string]*Page // TODO: consider indexing into an array of pages
+	Pages     PageStore
 	Datastore *Datastore
 	NumHashes uint64
+	// HashSplitDepth is the depth below which Root and Hash compute the nodes
+	// of different subtrees in parallel. Zero disables parallel hashing.
+	HashSplitDepth int
+
+	config
+	root  Node
+	dirty map[string]struct{} // paths of keys changed since they were last hashed
+
+	// Snapshots not yet released. snapshotMu guards their saved pages and
+	// changes to Pages while there are any.
+	snapshots  []*snapshotPages
+	snapshotMu sync.RWMutex
+
+	version uint64      // number of commits
+	history []*Snapshot // the last versions, oldest first, kept WithHistory
+
+	// The last committed version, published for View WithConcurrentReads,
+	// and earlier ones still being read.
+	epoch   atomic.Pointer[epoch]
+	retired []*epoch
+
+	// Set for trees opened with OpenTree.
+	dir string
+	wal *wal
+}
+
+// defaultHashSplitDepth splits the tree into 64 subtrees, one for each node
+// at the bottom of the root page.
+const defaultHashSplitDepth = fullBits
+
+func NewTree(opts ...Option) *Tree {
+	t := &Tree{
+		Pages:          newMemPageStore(),
+		Datastore:      New(),
+		HashSplitDepth: defaultHashSplitDepth,
+		dirty:          make(map[string]struct{}),
+		config:         newConfig(opts),
+	}
+	t.publish()
+	return t
+}
+
+const (
+	rootFileName   = "root"
+	configFileName = "config"
+)
+
+// ErrConfigMismatch is returned by OpenTree when the tree was created with
+// another Hasher, or with or without WithDomainSeparation or WithHashedKeys.
+var ErrConfigMismatch = errors.New("nomt: options differ from those the tree was created with")
+
+// OpenTree opens the tree persisted in dir, creating an empty one if needed.
+// Pages are stored in dir, in a BucketPageStore, and loaded on demand, while
+// the Datastore is kept in memory. Trees created before pages were stored in
+// buckets keep theirs in a DirPageStore.
+// A commit interrupted by a crash is replayed from the write-ahead log,
+// and the Datastore's free list is rebuilt from the pages if it was not closed cleanly.
+//
+// The options the tree's nodes depend on are saved in dir, and it returns
+// ErrConfigMismatch if opts differ from them. Trees created before they were
+// saved take those they are first opened with.
+func OpenTree(dir string, opts ...Option) (*Tree, error) {
+	c := newConfig(opts)
+	pages, err := openPageStore(dir, c.pageBuckets)
+	if err != nil {
+		return nil, err
+	}
+	datastore, err := OpenDatastore(filepath.Join(dir, "chunks"))
+	if err != nil {
+		closePageStore(pages)
+		return nil, err
+	}
+	wal, err := openWAL(filepath.Join(dir, "wal"))
+	if err != nil {
+		closePageStore(pages)
+		datastore.file.Close()
+		return nil, err
+	}
+	t := &Tree{
+		Pages:          pages,
+		Datastore:      datastore,
+		HashSplitDepth: defaultHashSplitDepth,
+		dirty:          make(map[string]struct{}),
+		config:         c,
+		dir:            dir,
+		wal:            wal,
+	}
+	if err := t.open(); err != nil {
+		closePageStore(pages)
+		datastore.file.Close()
+		wal.close()
+		return nil, err
+	}
+	t.publish()
+	return t, nil
+}
+
+// openPageStore opens the page store of the tree persisted in dir.
+func openPageStore(dir string, numBuckets int) (PageStore, error) {
+	if info, err := os.Stat(filepath.Join(dir, "pages")); err == nil && info.IsDir() {
+		return OpenDirPageStore(filepath.Join(dir, "pages"))
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return OpenBucketPageStore(filepath.Join(dir, "pages.ht"), numBuckets)
+}
+
+// checkConfig checks that the tree's options match those saved in its directory,
+// saving them if there are none.
+func (t *Tree) checkConfig() error {
+	path := filepath.Join(t.dir, configFileName)
+	saved, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return replaceFile(path, t.fingerprint())
+	case err != nil:
+		return err
+	case !bytes.Equal(saved, t.fingerprint()):
+		return ErrConfigMismatch
+	}
+	return nil
+}
+
+func (t *Tree) open() error {
+	if err := t.checkConfig(); err != nil {
+		return err
+	}
+	if t.Pages.Page(nil) == nil {
+		t.Pages.Put(nil, t.newPage())
+	}
+	if err := pageStoreErr(t.Pages); err != nil {
+		return err
+	}
+
+	root, err := os.ReadFile(filepath.Join(t.dir, rootFileName))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	case len(root) != len(t.root) && len(root) != len(t.root)+8:
+		return fmt.Errorf("invalid root file: %d bytes", len(root))
+	default:
+		// Root files written before versions were kept hold the root only.
+		copy(t.root[:], root)
+		if len(root) > len(t.root) {
+			t.version = binary.BigEndian.Uint64(root[len(t.root):])
+		}
+	}
+
+	rec, err := t.wal.read()
+	if err != nil {
+		return err
+	}
+	if rec != nil {
+		if err := t.replay(rec); err != nil {
+			return err
+		}
+	}
+	if err := t.wal.clear(); err != nil {
+		return err
+	}
+
+	if t.Datastore.NeedsRebuild() {
+		return t.Datastore.RebuildFreeList(t.markChunks)
+	}
+	return nil
+}
+
+// markChunks calls mark for each chunk referenced by a leaf.
+func (t *Tree) markChunks(mark func(idx uint32)) error {
+	return t.Pages.Range(func(_ []byte, page *Page) bool {
+		page.chunks(t.Datastore, mark)
+		return true
+	})
+}
+
+// Flush persists the pages and chunks modified since the last call to Flush,
+// the root and the version. Keys changed since they were last hashed are hashed
+// first, as by Root, so that the root persisted is that of the pages.
+// For trees opened with OpenTree, the changes are recorded in the write-ahead
+// log first, as by Commit, so that after a crash the tree reflects either all
+// or none of them. Trees created by NewTree are not persisted.
+func (t *Tree) Flush() error {
+	t.Root()
+	if t.wal == nil {
+		return t.flush()
+	}
+	return t.persist(&Batch{})
+}
+
+// flush writes the changes Flush persists in place.
+func (t *Tree) flush() error {
+	if err := t.Pages.Flush(); err != nil {
+		return err
+	}
+	if err := t.Datastore.Flush(); err != nil {
+		return err
+	}
+	if t.dir == "" {
+		return nil
+	}
+	root := binary.BigEndian.AppendUint64(t.root[:len(t.root):len(t.root)], t.version)
+	return replaceFile(filepath.Join(t.dir, rootFileName), root)
+}
+
+// Close flushes the tree, drops its history and closes its page store and Datastore.
+// No reader may be in View.
+func (t *Tree) Close() error {
+	if err := t.Flush(); err != nil {
+		return err
+	}
+	if t.wal != nil {
+		if err := t.wal.close(); err != nil {
+			return err
+		}
+	}
+	if err := closePageStore(t.Pages); err != nil {
+		return err
+	}
+	t.pruneHistory(0)
+	t.retire()
+	return t.Datastore.Close()
 }
 
-func NewTree() *Tree {
-	return &Tree{
-		Pages: map[string]*Page{
-			"": {},
-		},
-		Datastore: New(),
+// markDirty records that the key with the given path changed, so that Root rehashes it.
+// Converting the path to a map key allocates, so it is only done for paths not yet recorded.
+func (t *Tree) markDirty(path []byte) {
+	if _, ok := t.dirty[string(path)]; !ok {
+		t.dirty[string(path)] = struct{}{}
+	}
+}
+
+// pageForWrite returns the page to modify in place of page, found at path.
+// It must be called before modifying a page returned by lookup.
+// If a snapshot still reads page, it is left to the snapshot and a copy is returned.
+func (t *Tree) pageForWrite(path []byte, page *Page) *Page {
+	if len(t.snapshots) > 0 {
+		t.snapshotMu.Lock()
+		defer t.snapshotMu.Unlock()
+		// Workers hashing in parallel share the pages above the split depth,
+		// so another one may have copied the page since it was read.
+		page = t.page(path)
+		if t.preserve(path, page) {
+			copied := t.newPage()
+			*copied = *page
+			page = copied
+		}
+	}
+	t.storePage(path, page)
+	return page
+}
+
+// putPage stores a new page at path, where there was none.
+func (t *Tree) putPage(path []byte, page *Page) {
+	if len(t.snapshots) > 0 {
+		t.snapshotMu.Lock()
+		defer t.snapshotMu.Unlock()
+		t.preserve(path, nil)
+	}
+	t.storePage(path, page)
+}
+
+// deletePage removes the page at path, freeing it unless a snapshot still reads it.
+func (t *Tree) deletePage(path []byte) {
+	page := t.page(path)
+	if len(t.snapshots) > 0 {
+		t.snapshotMu.Lock()
+		defer t.snapshotMu.Unlock()
+		if t.preserve(path, page) {
+			page = nil
+		}
+	}
+	t.removePage(path)
+	if page != nil {
+		t.freePage(page)
 	}
 }
 
@@ -95,7 +411,7 @@ func (t *Tree) lookup(paddedKey []byte, partialBits int) (int, byte, *Page) {
 	// The last byte in the padded key always indexes into the page.
 	// This page may be the root page or a page with a path that is a prefix of the key.
 	pageIdx := 0
-	page := t.Pages[""] // start at the root
+	page := t.page(nil) // start at the root
 	for pageIdx < len(paddedKey)-1 {
 		// If this node is not set, the continuation page does not exist.
 		node := &page.Nodes[indexOf(paddedKey[pageIdx], fullBits)]
@@ -103,7 +419,7 @@ func (t *Tree) lookup(paddedKey []byte, partialBits int) (int, byte, *Page) {
 			break
 		}
 		pageIdx++
-		page = t.Pages[string(paddedKey[:pageIdx])]
+		page = t.page(paddedKey[:pageIdx])
 	}
 
 	bits := byte(fullBits)
@@ -114,10 +430,15 @@ func (t *Tree) lookup(paddedKey []byte, partialBits int) (int, byte, *Page) {
 	return pageIdx, pathLen, page
 }
 
+// Get returns the value stored under key, read into valBuf
+// or into a new slice if valBuf is too small.
 func (t *Tree) Get(key []byte, valBuf []byte) ([]byte, bool) {
+	if len(key) > t.maxKeyLen() {
+		return nil, false
+	}
 	var paddedKeyBuf [MaxKeyLenPadded]byte
 	paddedKey := paddedKeyBuf[:]
-	paddedKey, partialBits := PadKey(key, paddedKey)
+	paddedKey, partialBits := PadKey(t.path(key), paddedKey)
 	pageIdx, pathLen, page := t.lookup(paddedKey, partialBits)
 	if pathLen == 0 {
 		return nil, false
@@ -127,7 +448,7 @@ func (t *Tree) Get(key []byte, valBuf []byte) ([]byte, bool) {
 		return nil, false
 	}
 
-	var keyBuf [MaxKeyLen]byte
+	var keyBuf [MaxHashedKeyLen]byte
 	foundKey := keyBuf[:]
 	leaf := node.AsLeafNode()
 	foundKey = leaf.GetKey(foundKey, t.Datastore)
@@ -137,55 +458,96 @@ func (t *Tree) Get(key []byte, valBuf []byte) ([]byte, bool) {
 	return leaf.GetValue(valBuf, t.Datastore), true
 }
 
-func (t *Tree) Put(key, value []byte) {
+// Put sets key to value. If they cannot be stored, it returns ErrEmptyKey, ErrKeyTooLong,
+// ErrValueTooLong, ErrKeyPrefixConflict or ErrOutOfChunks, leaving the tree unchanged.
+func (t *Tree) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > t.maxKeyLen() {
+		return ErrKeyTooLong
+	}
+	if len(value) > MaxValueLen {
+		return ErrValueTooLong
+	}
+	path := t.path(key)
 	var paddedKeyBuf [MaxKeyLenPadded]byte
 	paddedKey := paddedKeyBuf[:]
-	paddedKey, partialBits := PadKey(key, paddedKey)
+	paddedKey, partialBits := PadKey(path, paddedKey)
 	pageIdx, pathLen, page := t.lookup(paddedKey, partialBits)
 
+	// Check that the key fits below the node its path ends at before changing anything.
+	var node *Node
+	var keyBuf [MaxHashedKeyLen]byte
+	var foundKey []byte
+	var foundKeyPaddedBuf [MaxKeyLenPadded]byte
+	var foundKeyPadded []byte
+	if pathLen > 0 {
+		node = &page.Nodes[indexOf(paddedKey[pageIdx], pathLen)]
+		depth := fullBits*pageIdx + int(pathLen)
+		if node.IsHash() {
+			if depth == pathDepth(paddedKey, partialBits) {
+				// Every node on the key's path is taken by an internal node.
+				return ErrKeyPrefixConflict
+			}
+		} else if foundKey = node.AsLeafNode().GetKey(keyBuf[:], t.Datastore); !bytes.Equal(foundKey, key) {
+			var foundPartialBits int
+			foundKeyPadded, foundPartialBits = PadKey(t.path(foundKey), foundKeyPaddedBuf[:])
+			if isPathPrefix(paddedKey, pathDepth(paddedKey, partialBits), foundKeyPadded, pathDepth(foundKeyPadded, foundPartialBits), depth) {
+				return ErrKeyPrefixConflict
+			}
+		}
+	}
+	// The key is either stored in a new leaf or its leaf is updated.
+	// A leaf a snapshot or shadowed datastore may share is updated by moving it to new chunks.
+	target := &LeafNode{}
+	if pathLen > 0 && !node.IsHash() && foundKeyPadded == nil && len(t.snapshots) == 0 && t.Datastore.readOnly == 0 {
+		target = node.AsLeafNode()
+	}
+	if err := target.reserve(len(key), len(value), t.Datastore); err != nil {
+		return err
+	}
+	page = t.pageForWrite(paddedKey[:pageIdx], page)
+	if pathLen > 0 {
+		node = &page.Nodes[indexOf(paddedKey[pageIdx], pathLen)]
+	}
+	t.markDirty(path)
+
 	getOrAllocate := func(paddedKey []byte, pathLen byte) *Node {
 		if pathLen == fullBits {
 			// Need a new page
-			page = &Page{}
+			page = t.newPage()
 			pageIdx++
-			t.Pages[string(paddedKey[:pageIdx])] = page
+			t.putPage(paddedKey[:pageIdx], page)
 			// Since this is a new page, 1 bits is used here.
 			return &page.Nodes[indexOf(paddedKey[pageIdx], 1)]
 		}
 		return &page.Nodes[indexOf(paddedKey[pageIdx], pathLen+1)]
 	}
 
-	if pathLen == 0 {
+	if pathLen == 0 || node.IsHash() {
 		// Create a new leaf node at pathLen+1
 		ptr := getOrAllocate(paddedKey, pathLen)
 		leafNode := ptr.AsLeafNode()
-		leafNode.PutKeyValue(key, value, t.Datastore)
-		return
-	}
-
-	node := &page.Nodes[indexOf(paddedKey[pageIdx], pathLen)]
-	if node.IsHash() {
-		ptr := getOrAllocate(paddedKey, pathLen)
-		leafNode := ptr.AsLeafNode()
-		leafNode.PutKeyValue(key, value, t.Datastore)
-		return
+		return leafNode.PutKeyValue(key, value, t.hasher, t.Datastore)
 	}
 
-	var keyBuf [MaxKeyLen]byte
-	foundKey := keyBuf[:]
-	leaf := node.AsLeafNode()
-	foundKey = leaf.GetKey(foundKey, t.Datastore)
-	if bytes.Equal(foundKey, key) {
-		leaf.PutValue(value, t.Datastore)
-		return
+	if foundKeyPadded == nil {
+		leaf := node.AsLeafNode()
+		if !leaf.shared(t.Datastore) {
+			return leaf.PutValue(value, t.hasher, t.Datastore)
+		}
+		old := *leaf
+		*node = Zero
+		err := leaf.PutKeyValue(key, value, t.hasher, t.Datastore)
+		old.Free(t.Datastore)
+		return err
 	}
 
 	// Split the leaf node
-	var foundKeyPaddedBuf [MaxKeyLenPadded]byte
-	foundKeyPadded := foundKeyPaddedBuf[:]
-	foundKeyPadded, _ = PadKey(foundKey, foundKeyPadded)
 	// Up until pageIdx:pathLen, the keys are guaranteed to be the same.
-	// We need to find the first bit where the keys differ.
+	// We need to find the first bit where the keys differ, which was
+	// checked to come before the end of either path.
 	var nextNode *Node
 	for {
 		nextNode = getOrAllocate(paddedKey, pathLen)
@@ -200,19 +562,98 @@ func (t *Tree) Put(key, value []byte) {
 		pathLen++
 	}
 	// At pathLen, the keys differ.
-	// Note keys MUST not be prefixes of each other.
 	leafNode := nextNode.AsLeafNode()
-	leafNode.PutKeyValue(key, value, t.Datastore)
+	err := leafNode.PutKeyValue(key, value, t.hasher, t.Datastore)
 
 	copyNode := getOrAllocate(foundKeyPadded, pathLen)
 	*copyNode = *node
 
 	node.MarkInternal() // Mark the old leaf node internal
+	return err
+}
+
+// pathDepth returns the depth of the deepest node on the path of a padded key.
+func pathDepth(paddedKey []byte, partialBits int) int {
+	return fullBits*len(paddedKey) - partialBits
+}
+
+// isPathPrefix reports whether the path of one of two padded keys is a prefix
+// of the other's, given that they are the same down to depth from.
+func isPathPrefix(a []byte, aDepth int, b []byte, bDepth int, from int) bool {
+	for depth := from; depth < min(aDepth, bDepth); depth++ {
+		if pathBit(a, depth) != pathBit(b, depth) {
+			return false
+		}
+	}
+	return true
+}
+
+// pathBit returns the bit of a padded key at the given depth (0 is the first bit).
+func pathBit(paddedKey []byte, depth int) byte {
+	return paddedKey[depth/fullBits] >> (fullBits - 1 - depth%fullBits) & 1
+}
+
+// Delete removes key from the tree and reports whether it was present.
+func (t *Tree) Delete(key []byte) bool {
+	if len(key) > t.maxKeyLen() {
+		return false
+	}
+	path := t.path(key)
+	var paddedKeyBuf [MaxKeyLenPadded]byte
+	paddedKey := paddedKeyBuf[:]
+	paddedKey, partialBits := PadKey(path, paddedKey)
+	pageIdx, pathLen, page := t.lookup(paddedKey, partialBits)
+	if pathLen == 0 {
+		return false
+	}
+	node := &page.Nodes[indexOf(paddedKey[pageIdx], pathLen)]
+	if node.IsHash() {
+		return false
+	}
+
+	var keyBuf [MaxHashedKeyLen]byte
+	if !bytes.Equal(node.AsLeafNode().GetKey(keyBuf[:], t.Datastore), key) {
+		return false
+	}
+	page = t.pageForWrite(paddedKey[:pageIdx], page)
+	t.markDirty(path)
+	node = &page.Nodes[indexOf(paddedKey[pageIdx], pathLen)]
+	node.AsLeafNode().Free(t.Datastore)
+	*node = Zero
+
+	// Removing the leaf may leave a single leaf below its parent.
+	// Undo the split done by Put by moving that leaf up until it has a non-empty sibling.
+	for pageIdx > 0 || pathLen > 1 {
+		nodeIdx := indexOf(paddedKey[pageIdx], pathLen)
+		node, sibling := &page.Nodes[nodeIdx], &page.Nodes[nodeIdx^1]
+		var lone Node
+		switch {
+		case node.IsZero() && !sibling.IsZero() && !sibling.IsHash():
+			lone = *sibling
+		case sibling.IsZero() && !node.IsZero() && !node.IsHash():
+			lone = *node
+		default:
+			return true
+		}
+		*node, *sibling = Zero, Zero
+
+		pathLen--
+		if pathLen == 0 {
+			// Both nodes at the top of the page are empty, so the whole page is.
+			t.deletePage(paddedKey[:pageIdx])
+			pageIdx--
+			page = t.pageForWrite(paddedKey[:pageIdx], t.page(paddedKey[:pageIdx]))
+			pathLen = fullBits
+		}
+		page.Nodes[indexOf(paddedKey[pageIdx], pathLen)] = lone
+	}
+	return true
 }
 
 func (t *Tree) print() {
-	for path, page := range t.Pages {
+	t.Pages.Range(func(path []byte, page *Page) bool {
 		fmt.Printf("Path: %x\n", path)
 		page.print()
-	}
+		return true
+	})
 }
@@ -43,6 +43,54 @@ func TestPadKey(t *testing.T) {
 	require.Equal(t, "00011010000001100001010100101100000110110000011000111100", BytesToBinaryString(padded))
 }
 
+func TestMaxKeyLen(t *testing.T) {
+	tr := NewTree()
+	keys := [][]byte{bytes.Repeat([]byte{0xff}, MaxKeyLen), bytes.Repeat([]byte{0xfe}, MaxKeyLen)}
+	for _, key := range keys {
+		require.NoError(t, tr.Put(key, key[:1]))
+	}
+	root := mustHash(t, tr, [][]byte{keys[1], keys[0]})
+	for _, key := range keys {
+		val, ok := tr.Get(key, nil)
+		require.True(t, ok)
+		require.Equal(t, key[:1], val)
+		proof, ok := tr.Prove(key)
+		require.True(t, ok)
+		require.True(t, VerifyProof(root, key, key[:1], proof))
+		n := 0
+		tr.ScanPrefix(key, func(k, _ []byte) bool {
+			require.Equal(t, key, k)
+			n++
+			return true
+		})
+		require.Equal(t, 1, n)
+	}
+
+	tooLong := make([]byte, MaxKeyLen+1)
+	require.ErrorIs(t, tr.Put(tooLong, nil), ErrKeyTooLong)
+	_, ok := tr.Get(tooLong, nil)
+	require.False(t, ok)
+	_, ok = tr.Prove(tooLong)
+	require.False(t, ok)
+	require.False(t, tr.Delete(tooLong))
+	tr.ScanPrefix(tooLong, func(_, _ []byte) bool {
+		t.Fatal("no key has a prefix longer than MaxKeyLen")
+		return false
+	})
+
+	for _, key := range keys {
+		require.True(t, tr.Delete(key))
+	}
+	require.Equal(t, Zero, tr.Root())
+}
+
+// mustHash is Tree.Hash, for keys that are known to be valid.
+func mustHash(t testing.TB, tr *Tree, keys [][]byte) Node {
+	root, err := tr.Hash(keys)
+	require.NoError(t, err)
+	return root
+}
+
 func TestPutGet(t *testing.T) {
 	tr := NewTree()
 
@@ -65,7 +113,7 @@ func TestPutGet(t *testing.T) {
 
 		require.Equal(t, value, val)
 
-		hash := tr.Hash([][]byte{key})
+		hash := mustHash(t, tr, [][]byte{key})
 		t.Logf("Hashes: %d Root: %x", tr.NumHashes-uint64(lastHashes), hash)
 		lastHashes = tr.NumHashes
 	}
@@ -151,6 +199,37 @@ func TestPutGetRandom(t *testing.T) {
 	}
 }
 
+// TestAllocs checks that lookups, updates of a key and rehashing
+// its path do not allocate, whichever built-in hasher is used.
+func TestAllocs(t *testing.T) {
+	for _, opts := range [][]Option{
+		nil,
+		{WithHasher(KeccakHasher{})},
+		{WithHasher(SHA256Hasher{}), WithDomainSeparation()},
+	} {
+		tr := NewTree(opts...)
+		keys := make([][]byte, 5000)
+		for i := range keys {
+			key := sha3.Sum256([]byte(fmt.Sprintf("key-%d", i)))
+			keys[i] = key[:]
+			require.NoError(t, tr.Put(keys[i], keys[i]))
+		}
+		tr.Root()
+
+		key := keys[len(keys)/2]
+		var valBuf [MaxInlineValueLen]byte
+		require.Zero(t, testing.AllocsPerRun(100, func() {
+			tr.Get(key, valBuf[:])
+		}), "Get")
+		require.Zero(t, testing.AllocsPerRun(100, func() {
+			tr.Put(key, valBuf[:32])
+		}), "Put")
+		require.Zero(t, testing.AllocsPerRun(100, func() {
+			tr.Hash(keys[len(keys)/2 : len(keys)/2+1])
+		}), "Hash")
+	}
+}
+
 func BenchmarkPut(b *testing.B) {
 	hasher := sha3.NewLegacyKeccak256()
 
@@ -253,7 +332,7 @@ func BenchmarkHash(b *testing.B) {
 			}
 
 			if currentSize%1_000_000 == 0 {
-				b.Logf("Size: %d, pages: %d (=%d G)", currentSize, len(tr.Pages), (len(tr.Pages)*4096)>>30)
+				b.Logf("Size: %d, pages: %d (=%d G)", currentSize, tr.Pages.Len(), (tr.Pages.Len()*4096)>>30)
 			}
 		}
 
@@ -261,7 +340,7 @@ func BenchmarkHash(b *testing.B) {
 		for _, batchSize := range []int{10, 100, 200, 500, 1000, 10_000, 40_000} {
 			b.Run(fmt.Sprintf("InitialSize-%d-BatchSize-%d", initialSize, batchSize), func(b *testing.B) {
 				b.ResetTimer()
-				b.ReportMetric(float64(len(tr.Pages)), "pages")
+				b.ReportMetric(float64(tr.Pages.Len()), "pages")
 				for i := 0; i < b.N; i++ {
 					var value [32]byte
 					r.Read(value[:])
@@ -282,3 +361,340 @@ func BenchmarkHash(b *testing.B) {
 		}
 	}
 }
+
+func TestDelete(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	hasher := sha3.NewLegacyKeccak256()
+
+	getKey := func(keyIdx int) []byte {
+		hasher.Write([]byte(fmt.Sprintf("key-%d", keyIdx)))
+		hash := hasher.Sum(nil)
+		hasher.Reset()
+		return hash
+	}
+
+	randomVal := func() []byte {
+		v := make([]byte, r.Intn(256))
+		r.Read(v)
+		return v
+	}
+
+	const numKeys = 2_000
+	tr := NewTree()
+	values := make(map[string][]byte)
+	var keys [][]byte
+	for i := 0; i < numKeys; i++ {
+		key, value := getKey(i), randomVal()
+		tr.Put(key, value)
+		values[string(key)] = value
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, bytes.Compare)
+	tr.Hash(keys)
+
+	require.False(t, tr.Delete([]byte("missing")))
+
+	// Delete half of the keys, in random order.
+	var deleted [][]byte
+	for _, i := range r.Perm(numKeys)[:numKeys/2] {
+		key := getKey(i)
+		require.True(t, tr.Delete(key))
+		require.False(t, tr.Delete(key))
+		delete(values, string(key))
+		deleted = append(deleted, key)
+	}
+	slices.SortFunc(deleted, bytes.Compare)
+	root := mustHash(t, tr, deleted)
+
+	var valBuf [256]byte
+	for _, key := range deleted {
+		_, ok := tr.Get(key, valBuf[:])
+		require.False(t, ok)
+	}
+
+	expected := NewTree()
+	var remaining [][]byte
+	for key, value := range values {
+		expected.Put([]byte(key), value)
+		remaining = append(remaining, []byte(key))
+
+		gotVal, ok := tr.Get([]byte(key), valBuf[:])
+		require.True(t, ok)
+		require.Equal(t, value, gotVal)
+	}
+	slices.SortFunc(remaining, bytes.Compare)
+	require.Equal(t, mustHash(t, expected, remaining), root)
+	require.Equal(t, expected.Pages.Len(), tr.Pages.Len())
+
+	// Deleting everything leaves an empty tree.
+	for _, key := range remaining {
+		require.True(t, tr.Delete(key))
+	}
+	require.Equal(t, Zero, mustHash(t, tr, remaining))
+	require.Equal(t, 1, tr.Pages.Len())
+	require.Zero(t, tr.Datastore.InUse())
+}
+
+func TestRoot(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tr := NewTree()
+	values := make(map[string][]byte)
+	for i := 0; i < 3_000; i++ {
+		key := sha3.Sum256([]byte(fmt.Sprintf("key-%d", r.Intn(1_000))))
+		if r.Intn(3) == 0 {
+			tr.Delete(key[:])
+			delete(values, string(key[:]))
+		} else {
+			value := []byte(fmt.Sprintf("value-%d", i))
+			tr.Put(key[:], value)
+			values[string(key[:])] = value
+		}
+
+		if i%500 == 0 {
+			expected := NewTree()
+			var keys [][]byte
+			for key, value := range values {
+				expected.Put([]byte(key), value)
+				keys = append(keys, []byte(key))
+			}
+			slices.SortFunc(keys, bytes.Compare)
+			require.Equal(t, mustHash(t, expected, keys), tr.Root())
+
+			// Nothing is rehashed until the tree changes again.
+			numHashes := tr.NumHashes
+			tr.Root()
+			require.Equal(t, numHashes, tr.NumHashes)
+		}
+	}
+}
+
+func TestHashParallel(t *testing.T) {
+	dirTree, err := OpenTree(t.TempDir())
+	require.NoError(t, err)
+	defer dirTree.Close()
+	dirTree.HashSplitDepth = 9
+
+	serial := NewTree()
+	serial.HashSplitDepth = 0
+	trees := []*Tree{serial, NewTree(), dirTree}
+	for _, splitDepth := range []int{1, 4, 12} {
+		tr := NewTree()
+		tr.HashSplitDepth = splitDepth
+		trees = append(trees, tr)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 2_000; i++ {
+			key := sha3.Sum256([]byte(fmt.Sprintf("key-%d", r.Intn(3_000))))
+			del := r.Intn(4) == 0
+			for _, tr := range trees {
+				if del {
+					tr.Delete(key[:])
+				} else {
+					tr.Put(key[:], []byte(fmt.Sprintf("value-%d-%d", round, i)))
+				}
+			}
+		}
+
+		root := serial.Root()
+		for _, tr := range trees[1:] {
+			require.Equal(t, root, tr.Root(), "split depth %d", tr.HashSplitDepth)
+		}
+	}
+}
+
+func TestLargeValues(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randomVal := func(n int) []byte {
+		v := make([]byte, n)
+		r.Read(v)
+		return v
+	}
+
+	for _, opts := range [][]Option{nil, {WithDomainSeparation()}} {
+		tr := NewTree(opts...)
+		values := make(map[string][]byte)
+		var keys [][]byte
+		for i, n := range []int{0, MaxInlineValueLen, MaxInlineValueLen + 1, 10_000, 4 << 20} {
+			key := sha3.Sum256([]byte(fmt.Sprintf("key-%d", i)))
+			values[string(key[:])] = randomVal(n)
+			tr.Put(key[:], values[string(key[:])])
+			keys = append(keys, key[:])
+		}
+		root := tr.Root()
+
+		var valBuf [MaxInlineValueLen]byte
+		for _, key := range keys {
+			val, ok := tr.Get(key, valBuf[:])
+			require.True(t, ok)
+			require.Equal(t, values[string(key)], val)
+
+			proof, ok := tr.Prove(key)
+			require.True(t, ok)
+			require.True(t, VerifyProof(root, key, values[string(key)], proof, opts...))
+			require.False(t, VerifyProof(root, key, append(values[string(key)], 0), proof, opts...))
+		}
+		slices.SortFunc(keys, bytes.Compare)
+		var vals [][]byte
+		for _, key := range keys {
+			vals = append(vals, values[string(key)])
+		}
+		multiProof, ok := tr.ProveMany(keys)
+		require.True(t, ok)
+		require.True(t, VerifyMultiProof(root, keys, vals, multiProof, opts...))
+
+		// The root only depends on the contents of the tree.
+		for _, key := range keys[:2] {
+			values[string(key)] = randomVal(20_000)
+			tr.Put(key, values[string(key)])
+		}
+		expected := NewTree(opts...)
+		for _, key := range keys {
+			expected.Put(key, values[string(key)])
+		}
+		require.Equal(t, expected.Root(), tr.Root())
+
+		for _, key := range keys {
+			require.True(t, tr.Delete(key))
+		}
+		require.Equal(t, Zero, tr.Root())
+		require.Zero(t, tr.Datastore.InUse())
+	}
+}
+
+func TestKeyPrefixConflict(t *testing.T) {
+	tr := NewTree()
+	require.NoError(t, tr.Put([]byte("abc"), []byte("value")))
+	root := tr.Root()
+	numChunks := tr.Datastore.InUse()
+
+	for _, key := range [][]byte{[]byte("ab"), []byte("abc\x00"), []byte("abc\x00\x00\x00")} {
+		require.ErrorIs(t, tr.Put(key, []byte("value")), ErrKeyPrefixConflict, "key %q", key)
+	}
+	require.ErrorIs(t, tr.Put(make([]byte, MaxKeyLen+1), nil), ErrKeyTooLong)
+	require.Equal(t, root, tr.Root())
+	require.Equal(t, numChunks, tr.Datastore.InUse())
+
+	// A key whose path ends at an internal node is neither deleted nor hashed.
+	prefixTree := NewTree()
+	for _, key := range [][]byte{{0x0a, 0, 0, 0, 0, 1}, {0x0a, 0, 0, 0, 0, 2}} {
+		require.NoError(t, prefixTree.Put(key, []byte("value")))
+	}
+	prefixRoot := prefixTree.Root()
+	for _, prefix := range [][]byte{{0x0a, 0, 0}, {0x0a}} {
+		require.False(t, prefixTree.Delete(prefix))
+		require.Equal(t, prefixRoot, mustHash(t, prefixTree, [][]byte{prefix}))
+	}
+	// Nor does it keep the key next to it from being hashed.
+	next := []byte{0x0a, 0, 0, 0, 0, 2}
+	require.NoError(t, prefixTree.Put(next, []byte("changed")))
+	serial := NewTree()
+	require.NoError(t, serial.Put([]byte{0x0a, 0, 0, 0, 0, 1}, []byte("value")))
+	require.NoError(t, serial.Put(next, []byte("changed")))
+	require.Equal(t, serial.Root(), mustHash(t, prefixTree, [][]byte{{0x0a, 0, 0}, next}))
+
+	// A key forking off the path of an internal node.
+	require.NoError(t, tr.Put([]byte("abd"), []byte("value")))
+	require.ErrorIs(t, tr.Put([]byte("ab"), []byte("value")), ErrKeyPrefixConflict)
+
+	var valBuf [MaxInlineValueLen]byte
+	for _, key := range []string{"abc", "abd"} {
+		val, ok := tr.Get([]byte(key), valBuf[:])
+		require.True(t, ok)
+		require.Equal(t, []byte("value"), val)
+	}
+}
+
+func TestHashedKeys(t *testing.T) {
+	opts := []Option{WithHashedKeys()}
+	tr := NewTree(opts...)
+	values := make(map[string][]byte)
+	var keys [][]byte
+	for i := 0; i < 500; i++ {
+		// Keys are prefixes of one another and up to MaxHashedKeyLen long.
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if i < MaxHashedKeyLen {
+			key = bytes.Repeat([]byte{'k'}, i+1)
+		}
+		values[string(key)] = []byte(fmt.Sprintf("value-%d", i))
+		require.NoError(t, tr.Put(key, values[string(key)]))
+		keys = append(keys, key)
+	}
+	require.ErrorIs(t, tr.Put(make([]byte, MaxHashedKeyLen+1), nil), ErrKeyTooLong)
+	slices.SortFunc(keys, bytes.Compare)
+
+	root := tr.Root()
+	expected := NewTree(opts...)
+	for _, key := range keys {
+		expected.Put(key, values[string(key)])
+	}
+	require.Equal(t, root, mustHash(t, expected, keys))
+
+	var valBuf [MaxInlineValueLen]byte
+	var vals [][]byte
+	for _, key := range keys {
+		val, ok := tr.Get(key, valBuf[:])
+		require.True(t, ok)
+		require.Equal(t, values[string(key)], val)
+		vals = append(vals, values[string(key)])
+
+		proof, ok := tr.Prove(key)
+		require.True(t, ok)
+		require.True(t, VerifyProof(root, key, val, proof, opts...))
+		require.False(t, VerifyProof(root, key, append(val, 0), proof, opts...))
+	}
+	multiProof, ok := tr.ProveMany(keys[:100])
+	require.True(t, ok)
+	require.True(t, VerifyMultiProof(root, keys[:100], vals[:100], multiProof, opts...))
+	require.False(t, VerifyMultiProof(root, keys[1:101], vals[:100], multiProof, opts...))
+
+	absent := []byte("absent")
+	_, ok = tr.Get(absent, valBuf[:])
+	require.False(t, ok)
+	absenceProof, ok := tr.ProveAbsent(absent)
+	require.True(t, ok)
+	require.True(t, VerifyAbsenceProof(root, absent, absenceProof, opts...))
+
+	for _, key := range keys {
+		require.True(t, tr.Delete(key))
+	}
+	require.Equal(t, Zero, tr.Root())
+	require.Zero(t, tr.Datastore.InUse())
+}
+
+func TestPutErrors(t *testing.T) {
+	tr := NewTree()
+	key := []byte("key")
+	require.NoError(t, tr.Put(key, []byte("value")))
+	root := tr.Root()
+
+	require.ErrorIs(t, tr.Put(make([]byte, MaxKeyLen+1), nil), ErrKeyTooLong)
+	require.ErrorIs(t, tr.Put(key, make([]byte, MaxValueLen+1)), ErrValueTooLong)
+
+	_, err := tr.Hash([][]byte{make([]byte, MaxKeyLen+1)})
+	require.ErrorIs(t, err, ErrKeyTooLong)
+	_, err = tr.Hash([][]byte{[]byte("b"), []byte("a")})
+	require.ErrorIs(t, err, ErrUnsortedKeys)
+
+	batch := &Batch{}
+	batch.Put([]byte("other"), nil)
+	batch.Put(key, make([]byte, MaxValueLen+1))
+	_, err = tr.Commit(batch)
+	require.ErrorIs(t, err, ErrValueTooLong)
+
+	// Pretend every chunk not yet allocated is in use.
+	tr.Datastore.NumChunks = MaxChunks
+	require.ErrorIs(t, tr.Put([]byte("other"), []byte("value")), ErrOutOfChunks)
+	require.ErrorIs(t, tr.Put(key, make([]byte, 1_000)), ErrOutOfChunks)
+	// Values using no more chunks can still be stored.
+	require.NoError(t, tr.Put(key, []byte("value")))
+
+	require.Equal(t, root, tr.Root())
+	var valBuf [MaxInlineValueLen]byte
+	_, ok := tr.Get([]byte("other"), valBuf[:])
+	require.False(t, ok)
+	val, ok := tr.Get(key, valBuf[:])
+	require.True(t, ok)
+	require.Equal(t, []byte("value"), val)
+}
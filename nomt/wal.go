@@ -0,0 +1,399 @@
+package nomt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Batch is a set of changes applied together by Tree.Commit.
+// Changes to the same key are applied in order.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key, value []byte
+	delete     bool
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: bytes.Clone(key), value: bytes.Clone(value)})
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: bytes.Clone(key), delete: true})
+}
+
+// Len returns the number of changes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Commit applies batch to the tree and returns the new root.
+//
+// For trees opened with OpenTree, the batch is recorded in a write-ahead log
+// before any page or chunk is written in place, and the tree is flushed.
+// After a crash, OpenTree replays the log so that the tree reflects either all
+// or none of the batch. If a change of the batch cannot be applied, Commit
+// returns its error, leaving the tree as it was. If Commit returns any other
+// error, the tree should be reopened.
+func (t *Tree) Commit(batch *Batch) (Node, error) {
+	root, err := t.apply(batch)
+	if err != nil {
+		return root, err
+	}
+	t.commitVersion()
+	return root, t.persist(batch)
+}
+
+// persist logs batch, which was just applied, and flushes the tree.
+// It has no effect on trees created by NewTree.
+func (t *Tree) persist(batch *Batch) error {
+	if t.wal == nil {
+		return nil
+	}
+	// Pages that could not be read must not be logged in their place.
+	if err := pageStoreErr(t.Pages); err != nil {
+		return err
+	}
+	if err := t.wal.write(t.walRecord(batch)); err != nil {
+		return err
+	}
+	if err := t.flush(); err != nil {
+		return err
+	}
+	return t.wal.clear()
+}
+
+// apply applies batch to the tree in memory and returns the new root.
+// Changes made before the batch are hashed and committed along with it.
+// Changes with empty keys, or keys or values that are too long, are rejected
+// before any is applied. Otherwise, if a change cannot be applied, those before it are undone.
+func (t *Tree) apply(batch *Batch) (Node, error) {
+	for _, op := range batch.ops {
+		if !op.delete && len(op.key) == 0 {
+			return t.root, ErrEmptyKey
+		}
+		if len(op.key) > t.maxKeyLen() {
+			return t.root, ErrKeyTooLong
+		}
+		if len(op.value) > MaxValueLen {
+			return t.root, ErrValueTooLong
+		}
+	}
+	if err := t.applyOps(batch.ops); err != nil {
+		return t.root, err
+	}
+	return t.Root(), nil
+}
+
+// applyOps applies ops in order. If one cannot be applied, the ones before it
+// are undone, leaving every key as it was, and its error is returned.
+func (t *Tree) applyOps(ops []batchOp) error {
+	undo := make([]batchOp, 0, len(ops))
+	for _, op := range ops {
+		old, ok := t.Get(op.key, nil)
+		var err error
+		if op.delete {
+			t.Delete(op.key)
+		} else {
+			err = t.Put(op.key, op.value)
+		}
+		if err != nil {
+			if undoErr := t.undo(undo); undoErr != nil {
+				return errors.Join(err, undoErr)
+			}
+			return err
+		}
+		undo = append(undo, batchOp{key: op.key, value: old, delete: !ok})
+	}
+	return nil
+}
+
+// undo restores the keys changed by the ops whose undo ops are given, in order.
+// Restoring a value only fails if the chunks freed since cannot hold it again,
+// in which case the tree should be reopened.
+func (t *Tree) undo(ops []batchOp) error {
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		if op.delete {
+			t.Delete(op.key)
+		} else if err := t.Put(op.key, op.value); err != nil {
+			return fmt.Errorf("undoing change to key %x: %w", op.key, err)
+		}
+	}
+	return nil
+}
+
+// A WAL record holds, in order:
+//   - walMagic, which records written before versions were logged lack
+//   - the root and version after the commit, or only the root in records without walMagic
+//   - the batch: the number of changes, then for each its kind (0 for Put, 1 for Delete),
+//     the key length, the key and, for a Put, the value length and the value
+//   - the modified pages: their number, then for each the path length, the path,
+//     whether it was deleted and, if not, the page
+//   - the modified chunks: the number of blocks, then for each the index of its
+//     first chunk, its number of chunks and the chunks
+//   - a CRC-32 checksum of all the above
+//
+// Integers are big-endian uint32s, except for the version, a big-endian uint64. The pages and chunks make replaying the record
+// idempotent, so it can be applied over a partially flushed commit.
+const (
+	walMagic  = "nomtwal1"
+	walPut    = 0
+	walDelete = 1
+)
+
+func (t *Tree) walRecord(batch *Batch) []byte {
+	rec := append([]byte(walMagic), t.root[:]...)
+	rec = binary.BigEndian.AppendUint64(rec, t.version)
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(batch.ops)))
+	for _, op := range batch.ops {
+		if op.delete {
+			rec = append(rec, walDelete)
+			rec = appendBytes(rec, op.key)
+		} else {
+			rec = append(rec, walPut)
+			rec = appendBytes(rec, op.key)
+			rec = appendBytes(rec, op.value)
+		}
+	}
+
+	var numPages uint32
+	pagesPos := len(rec)
+	rec = binary.BigEndian.AppendUint32(rec, 0)
+	if pages, ok := t.Pages.(changeLister); ok {
+		pages.Changes(func(path []byte, page *Page) {
+			numPages++
+			rec = appendBytes(rec, path)
+			if page == nil {
+				rec = append(rec, 1)
+			} else {
+				rec = append(rec, 0)
+				rec = append(rec, page.bytes()...)
+			}
+		})
+	}
+	binary.BigEndian.PutUint32(rec[pagesPos:], numPages)
+
+	var numBlocks uint32
+	blocksPos := len(rec)
+	rec = binary.BigEndian.AppendUint32(rec, 0)
+	t.Datastore.changes(func(idx uint32, data []byte) {
+		numBlocks++
+		rec = binary.BigEndian.AppendUint32(rec, idx)
+		rec = appendBytes(rec, data)
+	})
+	binary.BigEndian.PutUint32(rec[blocksPos:], numBlocks)
+
+	return binary.BigEndian.AppendUint32(rec, crc32.ChecksumIEEE(rec))
+}
+
+func appendBytes(rec, data []byte) []byte {
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(data)))
+	return append(rec, data...)
+}
+
+// walReader reads the fields of a WAL record, remembering the first error.
+type walReader struct {
+	rec []byte
+	err error
+}
+
+func (r *walReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.rec) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	data := r.rec[:n]
+	r.rec = r.rec[n:]
+	return data
+}
+
+func (r *walReader) uint32() uint32 {
+	if data := r.bytes(4); data != nil {
+		return binary.BigEndian.Uint32(data)
+	}
+	return 0
+}
+
+func (r *walReader) byte() byte {
+	if data := r.bytes(1); data != nil {
+		return data[0]
+	}
+	return 0
+}
+
+// replay applies a WAL record written by a commit that may not have been flushed.
+func (t *Tree) replay(rec []byte) error {
+	versioned := bytes.HasPrefix(rec, []byte(walMagic))
+	if versioned {
+		rec = rec[len(walMagic):]
+	}
+	r := &walReader{rec: rec}
+	copy(t.root[:], r.bytes(len(t.root)))
+	if versioned {
+		if data := r.bytes(8); data != nil {
+			t.version = binary.BigEndian.Uint64(data)
+		}
+	}
+	batch := &Batch{}
+	for n := r.uint32(); n > 0 && r.err == nil; n-- {
+		switch r.byte() {
+		case walPut:
+			key := r.bytes(int(r.uint32()))
+			batch.Put(key, r.bytes(int(r.uint32())))
+		case walDelete:
+			batch.Delete(r.bytes(int(r.uint32())))
+		default:
+			return fmt.Errorf("invalid WAL record: unknown change")
+		}
+	}
+	for n := r.uint32(); n > 0 && r.err == nil; n-- {
+		path := r.bytes(int(r.uint32()))
+		if r.byte() == 1 {
+			t.Pages.Delete(path)
+			continue
+		}
+		page := &Page{}
+		copy(page.bytes(), r.bytes(PageSize))
+		t.Pages.Put(path, page)
+	}
+	for n := r.uint32(); n > 0 && r.err == nil; n-- {
+		idx := r.uint32()
+		t.Datastore.restore(idx, r.bytes(int(r.uint32())))
+	}
+	if r.err != nil {
+		return fmt.Errorf("invalid WAL record: %w", r.err)
+	}
+
+	// The pages and chunks must hold the result of the batch.
+	var hashBytesBuf [2 * maxHashBytesLen]byte
+	rootPage := t.Pages.Page(nil)
+	pos := t.hashBytes(hashBytesBuf[:], &rootPage.Nodes[0], t.Datastore)
+	pos += t.hashBytes(hashBytesBuf[pos:], &rootPage.Nodes[1], t.Datastore)
+	if root := t.hashInternal(hashBytesBuf[:pos]); root != t.root && t.root != Zero {
+		return fmt.Errorf("invalid WAL record: root %x does not match pages", t.root)
+	}
+	changes := make(map[string]batchOp)
+	for _, op := range batch.ops {
+		changes[string(op.key)] = op
+	}
+	var valBuf [MaxInlineValueLen]byte
+	for key, op := range changes {
+		val, ok := t.Get([]byte(key), valBuf[:])
+		if ok == op.delete || !bytes.Equal(val, op.value) {
+			return fmt.Errorf("invalid WAL record: key %x not committed", key)
+		}
+	}
+	// open clears the log once the record is flushed.
+	return t.flush()
+}
+
+// wal is a write-ahead log holding at most one record, for the commit in progress.
+type wal struct {
+	file *os.File
+}
+
+func openWAL(path string) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// Neither the log nor the files of the tree created next to it
+	// may vanish along with their directory entries.
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &wal{file: f}, nil
+}
+
+func (w *wal) write(rec []byte) error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.WriteAt(rec, 0); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// read returns the record in the log, or nil if there is none.
+// A record that was not completely written is ignored.
+func (w *wal) read() ([]byte, error) {
+	data, err := io.ReadAll(io.NewSectionReader(w.file, 0, 1<<62))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, nil
+	}
+	rec, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(rec) != sum {
+		return nil, nil
+	}
+	return rec, nil
+}
+
+func (w *wal) clear() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+// writeFileSync writes data to the file at path, creating it if needed,
+// and waits for data to reach the disk. The file's directory must be synced
+// for a new file to be found after a crash.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replaceFile replaces the file at path with one holding data, so that
+// after a crash it holds either its old contents or data.
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir waits for the entries of dir to reach the disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
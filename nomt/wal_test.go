@@ -0,0 +1,235 @@
+package nomt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+)
+
+func testBatch(from, to int) *Batch {
+	batch := &Batch{}
+	for i := from; i < to; i++ {
+		key := sha3.Sum256([]byte(fmt.Sprintf("key-%d", i)))
+		if i%7 == 0 && i > 0 {
+			deleted := sha3.Sum256([]byte(fmt.Sprintf("key-%d", i-1)))
+			batch.Delete(deleted[:])
+		}
+		batch.Put(key[:], []byte(fmt.Sprintf("value-%d", i)))
+	}
+	return batch
+}
+
+// crash closes the tree's files without flushing it.
+func crash(t *testing.T, tr *Tree) {
+	require.NoError(t, closePageStore(tr.Pages))
+	require.NoError(t, tr.Datastore.file.Close())
+	require.NoError(t, tr.wal.close())
+}
+
+// requireBatch checks that the batch was applied to tr if applied is true,
+// or that none of its changes are visible otherwise.
+func requireBatch(t *testing.T, tr *Tree, batch *Batch, applied bool) {
+	final := make(map[string]batchOp)
+	for _, op := range batch.ops {
+		final[string(op.key)] = op
+	}
+	var valBuf [MaxInlineValueLen]byte
+	for _, op := range final {
+		val, ok := tr.Get(op.key, valBuf[:])
+		switch {
+		case !applied:
+			require.False(t, ok && !op.delete && string(val) == string(op.value))
+		case op.delete:
+			require.False(t, ok)
+		default:
+			require.True(t, ok)
+			require.Equal(t, op.value, val)
+		}
+	}
+}
+
+func TestCommit(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := OpenTree(dir)
+	require.NoError(t, err)
+	expected := NewTree()
+
+	for i := 0; i < 5; i++ {
+		batch := testBatch(i*100, (i+1)*100)
+		root, err := tr.Commit(batch)
+		require.NoError(t, err)
+		expectedRoot, err := expected.Commit(batch)
+		require.NoError(t, err)
+		require.Equal(t, expectedRoot, root)
+	}
+	require.NoError(t, tr.Close())
+
+	tr, err = OpenTree(dir)
+	require.NoError(t, err)
+	require.Equal(t, expected.Root(), tr.Root())
+	requireBatch(t, tr, testBatch(400, 500), true)
+	require.NoError(t, tr.Close())
+}
+
+func TestCommitFailed(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := OpenTree(dir)
+	require.NoError(t, err)
+	initial := testBatch(0, 100)
+	_, err = tr.Commit(initial)
+	require.NoError(t, err)
+	root := tr.Root()
+	numChunks := tr.Datastore.InUse()
+
+	// The last put conflicts with the one before it, once both have been applied.
+	batch := testBatch(100, 200)
+	batch.Delete(initial.ops[0].key)
+	batch.Put([]byte("abc"), []byte("value"))
+	batch.Put([]byte("abc\x00"), []byte("value"))
+	_, err = tr.Commit(batch)
+	require.ErrorIs(t, err, ErrKeyPrefixConflict)
+	require.Equal(t, root, tr.Root())
+	require.Equal(t, numChunks, tr.Datastore.InUse())
+	requireBatch(t, tr, initial, true)
+	requireBatch(t, tr, batch, false)
+
+	// The tree can still be committed to, and reopened.
+	batch = testBatch(100, 200)
+	root, err = tr.Commit(batch)
+	require.NoError(t, err)
+	require.NoError(t, tr.Close())
+	tr, err = OpenTree(dir)
+	require.NoError(t, err)
+	require.Equal(t, root, tr.Root())
+	requireBatch(t, tr, batch, true)
+	require.NoError(t, tr.Close())
+}
+
+func TestCommitRecovery(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		crash   func(t *testing.T, tr *Tree, rec []byte)
+		applied bool
+	}{
+		{
+			name: "logged",
+			crash: func(t *testing.T, tr *Tree, rec []byte) {
+				require.NoError(t, tr.wal.write(rec))
+			},
+			applied: true,
+		},
+		{
+			name: "partially flushed",
+			crash: func(t *testing.T, tr *Tree, rec []byte) {
+				require.NoError(t, tr.wal.write(rec))
+				require.NoError(t, tr.Pages.Flush())
+			},
+			applied: true,
+		},
+		{
+			name: "logged before versions",
+			crash: func(t *testing.T, tr *Tree, rec []byte) {
+				// Drop the magic and the version, as records used to.
+				body := rec[len(walMagic) : len(rec)-4]
+				body = append(bytes.Clone(body[:len(Node{})]), body[len(Node{})+8:]...)
+				require.NoError(t, tr.wal.write(binary.BigEndian.AppendUint32(body, crc32.ChecksumIEEE(body))))
+			},
+			applied: true,
+		},
+		{
+			name: "torn log",
+			crash: func(t *testing.T, tr *Tree, rec []byte) {
+				require.NoError(t, tr.wal.write(rec[:len(rec)-1]))
+			},
+			applied: false,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tr, err := OpenTree(dir)
+			require.NoError(t, err)
+			before, err := tr.Commit(testBatch(0, 1_000))
+			require.NoError(t, err)
+
+			batch := testBatch(1_000, 2_000)
+			after, err := tr.apply(batch)
+			require.NoError(t, err)
+			tt.crash(t, tr, tr.walRecord(batch))
+			crash(t, tr)
+
+			tr, err = OpenTree(dir)
+			require.NoError(t, err)
+			requireBatch(t, tr, testBatch(0, 1_000), true)
+			requireBatch(t, tr, batch, tt.applied)
+			if tt.applied {
+				require.Equal(t, after, tr.Root())
+			} else {
+				require.Equal(t, before, tr.Root())
+			}
+
+			// The tree can be committed to after recovery.
+			expected := NewTree()
+			_, err = expected.Commit(testBatch(0, 1_000))
+			require.NoError(t, err)
+			if tt.applied {
+				_, err = expected.Commit(batch)
+				require.NoError(t, err)
+			}
+			batch = testBatch(2_000, 3_000)
+			root, err := tr.Commit(batch)
+			require.NoError(t, err)
+			expectedRoot, err := expected.Commit(batch)
+			require.NoError(t, err)
+			require.Equal(t, expectedRoot, root)
+			require.NoError(t, tr.Close())
+		})
+	}
+}
+
+// interruptedFlush crashes after the pages are written in place.
+type interruptedFlush struct {
+	*BucketPageStore
+}
+
+func (s interruptedFlush) Flush() error {
+	if err := s.BucketPageStore.Flush(); err != nil {
+		return err
+	}
+	return errors.New("crashed")
+}
+
+func TestFlushRecovery(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := OpenTree(dir)
+	require.NoError(t, err)
+	_, err = tr.Commit(testBatch(0, 1_000))
+	require.NoError(t, err)
+
+	// Changes made outside a batch are logged when flushed.
+	batch := testBatch(1_000, 2_000)
+	for _, op := range batch.ops {
+		if op.delete {
+			tr.Delete(op.key)
+		} else {
+			require.NoError(t, tr.Put(op.key, op.value))
+		}
+	}
+	tr.Pages = interruptedFlush{tr.Pages.(*BucketPageStore)}
+	require.Error(t, tr.Flush())
+	root := tr.Root()
+	tr.Pages = tr.Pages.(interruptedFlush).BucketPageStore
+	crash(t, tr)
+
+	tr, err = OpenTree(dir)
+	require.NoError(t, err)
+	requireBatch(t, tr, testBatch(0, 1_000), true)
+	requireBatch(t, tr, batch, true)
+	require.Equal(t, root, tr.Root())
+	require.NoError(t, tr.Close())
+}